@@ -0,0 +1,18 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/benjaminclauss/protohackers/speeddaemon"
+)
+
+// speedDaemonRecordsHandler serves a JSON snapshot of the speed daemon's records pipeline.
+func speedDaemonRecordsHandler(p *speeddaemon.RecordPipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.Stats()); err != nil {
+			LogWriteError(err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/benjaminclauss/protohackers/linereversal"
+)
+
+// LineReversal reverses each line of text received over an LRCP session and sends it back.
+func LineReversal(conn net.Conn) error {
+	defer CloseOrLog(conn)
+
+	reader := bufio.NewReader(conn)
+	for {
+		// Application-layer messages are lines of ASCII text terminated by a newline character.
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A partial line at the end of the session is never completed, so it is not reversed.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("read error: %w", err)
+		}
+
+		if _, err := io.WriteString(conn, reverse(strings.TrimSuffix(line, "\n"))+"\n"); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+	}
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	slices.Reverse(b)
+	return string(b)
+}
+
+// lineReversalSessionsHandler serves a JSON snapshot of the LRCP sessions of l.
+func lineReversalSessionsHandler(l *linereversal.LRCPListener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(l.Stats()); err != nil {
+			LogWriteError(err)
+		}
+	}
+}
@@ -21,6 +21,8 @@ func landingPageHandler(w http.ResponseWriter, r *http.Request) {
 			<p><strong>Version:</strong> %s</p>
 			<p><strong>Commit:</strong> %s</p>
 			<p><strong>Build Time:</strong> %s</p>
+			<p><a href="/linereversal/sessions">Line Reversal sessions</a></p>
+			<p><a href="/speeddaemon/records">Speed Daemon records pipeline</a></p>
 		</body>
 		</html>`, Version, Commit, BuildTime)
 	w.Header().Set("Content-Type", "text/html")
@@ -0,0 +1,382 @@
+// Command speeddaemon-sim drives simulated traffic through a speed daemon server and checks the tickets it issues.
+//
+// Cameras are spread across roads, and every road has a dispatcher. Each car drives past every camera on a road once
+// a day at a speed drawn from a normal distribution, so each day it either must, may or must not be ticketed. The
+// simulation fails if a car is ticketed when it must not be, is ticketed more than once on a day, is not ticketed on
+// a day it was speeding by 0.5 mph or more, or is sent a ticket that does not match its observations.
+//
+// Run it against a local server with:
+//
+//	go run ./cmd/speeddaemon-sim -local
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benjaminclauss/protohackers/speeddaemon"
+)
+
+var (
+	addr        = flag.String("addr", "localhost:50007", "address of the speed daemon server")
+	local       = flag.Bool("local", false, "run an in-process server instead of connecting to -addr")
+	roads       = flag.Int("roads", 4, "number of roads")
+	cameras     = flag.Int("cameras", 16, "number of cameras, spread across the roads")
+	dispatchers = flag.Int("dispatchers", 2, "number of dispatchers, sharing the roads between them")
+	cars        = flag.Int("cars", 200, "number of cars")
+	days        = flag.Int("days", 3, "number of days each car drives")
+	limit       = flag.Int("limit", 60, "speed limit of the first road; other roads vary around it")
+	speedMean   = flag.Float64("speed-mean", 1, "mean speed of a car, as a fraction of the road's limit")
+	speedStddev = flag.Float64("speed-stddev", 0.1, "standard deviation of the speed of a car, as a fraction of the road's limit")
+	seed        = flag.Uint64("seed", 1, "random seed")
+	timeout     = flag.Duration("timeout", 30*time.Second, "how long to wait for the expected tickets")
+	grace       = flag.Duration("grace", time.Second, "how long to wait for unexpected tickets after the expected ones arrive")
+	verbose     = flag.Bool("v", false, "log everything the local server logs")
+)
+
+// logger reports the progress of the simulation, separately from the logs of a local server.
+var logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+// A road is a simulated road with its cameras.
+type road struct {
+	number uint16
+	limit  uint16
+	miles  []uint16
+}
+
+type observation struct {
+	mile      uint16
+	timestamp uint32
+}
+
+// A trip is a car driving the length of a road on a day.
+type trip struct {
+	plate        string
+	road         *road
+	day          uint32
+	observations []observation
+	// required is set if the car must be ticketed, and allowed if it may be.
+	required, allowed bool
+}
+
+// A delivery is a ticket received by the dispatcher for roads.
+type delivery struct {
+	ticket speeddaemon.TicketMessage
+	roads  []uint16
+}
+
+type tripKey struct {
+	plate string
+	day   uint32
+}
+
+func main() {
+	flag.Parse()
+	if !*verbose {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	}
+	if err := run(); err != nil {
+		logger.Error("simulation failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *roads < 1 || *dispatchers < 1 || *cameras < 2*(*roads) {
+		return fmt.Errorf("need at least 1 road, 1 dispatcher and 2 cameras per road")
+	}
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+
+	if *local {
+		serverAddr, stop, err := startLocalServer()
+		if err != nil {
+			return fmt.Errorf("error starting local server: %w", err)
+		}
+		defer stop()
+		*addr = serverAddr
+	}
+
+	network := buildRoads()
+	trips := drive(rng, network)
+
+	tickets := make(chan delivery)
+	for i := range *dispatchers {
+		// Roads are dealt out to the dispatchers, and any dispatchers left over share a road with another.
+		var responsible []uint16
+		for j, r := range network {
+			if j%*dispatchers == i || (i >= len(network) && j == i%len(network)) {
+				responsible = append(responsible, r.number)
+			}
+		}
+		d, err := speeddaemon.DialDispatcher(*addr, responsible...)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		go func() {
+			for t := range d.Tickets() {
+				tickets <- delivery{ticket: t, roads: responsible}
+			}
+		}()
+	}
+
+	// Tickets are collected while plates are reported, so dispatchers never hold up the server.
+	type result struct {
+		received int
+		err      error
+	}
+	collected := make(chan result)
+	start := time.Now()
+	go func() {
+		received, err := collect(tickets, trips, start)
+		collected <- result{received: received, err: err}
+	}()
+
+	sent, err := report(network, trips)
+	if err != nil {
+		return err
+	}
+	reported := time.Since(start)
+	logger.Info("reported plates", "observations", sent, "elapsed", reported,
+		"per_second", float64(sent)/reported.Seconds())
+
+	r := <-collected
+	if r.err != nil {
+		return r.err
+	}
+	logger.Info("received tickets", "tickets", r.received)
+	return nil
+}
+
+// buildRoads spreads the cameras across the roads, 10 miles apart.
+func buildRoads() []*road {
+	network := make([]*road, *roads)
+	for i := range network {
+		network[i] = &road{number: uint16(i + 1), limit: uint16(*limit + 10*(i%3))}
+	}
+	for i := range *cameras {
+		r := network[i%len(network)]
+		r.miles = append(r.miles, uint16(10*(len(r.miles)+1)))
+	}
+	return network
+}
+
+// drive sends each car along a random road once a day, and works out whether each trip must be ticketed.
+func drive(rng *rand.Rand, network []*road) map[tripKey]*trip {
+	trips := make(map[tripKey]*trip)
+	for c := range *cars {
+		plate := "SIM" + strings.ToUpper(strconv.FormatInt(int64(c), 36))
+		for d := range uint32(*days) {
+			r := network[rng.IntN(len(network))]
+			length := float64(r.miles[len(r.miles)-1] - r.miles[0])
+			mph := float64(r.limit) * (*speedMean + rng.NormFloat64()**speedStddev)
+			// Speeds are clamped so every trip fits in a day and every ticket speed fits in a uint16.
+			mph = min(max(mph, 5, length*3600/80000), 600)
+
+			duration := uint32(math.Ceil(length / mph * 3600))
+			// Each day starts 1000 days after the epoch, to keep timestamps realistic.
+			day := 1000 + d
+			start := day*86400 + rng.Uint32N(86400-duration)
+
+			t := &trip{plate: plate, road: r, day: day}
+			for _, mile := range r.miles {
+				offset := float64(mile-r.miles[0]) / mph * 3600
+				t.observations = append(t.observations, observation{mile: mile, timestamp: start + uint32(math.Round(offset))})
+			}
+			t.required, t.allowed = classify(t)
+			trips[tripKey{plate: plate, day: day}] = t
+		}
+	}
+	return trips
+}
+
+// classify reports whether a trip must be ticketed, because a car exceeded the limit by 0.5 mph or more between two
+// cameras, and whether it may be, because it exceeded the limit at all.
+func classify(t *trip) (required, allowed bool) {
+	for i := 1; i < len(t.observations); i++ {
+		mph := speed(t.observations[i-1], t.observations[i])
+		required = required || mph >= float64(t.road.limit)+0.5
+		allowed = allowed || mph > float64(t.road.limit)
+	}
+	return required, allowed
+}
+
+func speed(a, b observation) float64 {
+	return float64(b.mile-a.mile) / float64(b.timestamp-a.timestamp) * 3600
+}
+
+// report connects every camera and reports the plates it sees, in the order it sees them.
+func report(network []*road, trips map[tripKey]*trip) (int, error) {
+	type sighting struct {
+		plate     string
+		timestamp uint32
+	}
+	sightings := make(map[*road][][]sighting)
+	for _, r := range network {
+		sightings[r] = make([][]sighting, len(r.miles))
+	}
+	for _, t := range trips {
+		for i, o := range t.observations {
+			sightings[t.road][i] = append(sightings[t.road][i], sighting{plate: t.plate, timestamp: o.timestamp})
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, *cameras)
+	var sent int
+	for _, r := range network {
+		for i, mile := range r.miles {
+			seen := sightings[r][i]
+			slices.SortFunc(seen, func(a, b sighting) int { return cmp.Compare(a.timestamp, b.timestamp) })
+			sent += len(seen)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := speeddaemon.DialCamera(*addr, r.number, mile, r.limit)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer c.Close()
+				for _, s := range seen {
+					if err := c.ReportPlate(s.plate, s.timestamp); err != nil {
+						errs <- fmt.Errorf("error reporting plate from camera at road %d mile %d: %w", r.number, mile, err)
+						return
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return sent, err
+	}
+	return sent, nil
+}
+
+// collect checks tickets as they arrive, until every required ticket has arrived and no more arrive within the grace
+// period.
+func collect(tickets <-chan delivery, trips map[tripKey]*trip, start time.Time) (int, error) {
+	var missing int
+	for _, t := range trips {
+		if t.required {
+			missing++
+		}
+	}
+	logger.Info("waiting for tickets", "required", missing, "trips", len(trips))
+
+	ticketed := make(map[tripKey]bool)
+	deadline := time.After(*timeout)
+	var quiet <-chan time.Time
+	if missing == 0 {
+		quiet = time.After(*grace)
+	}
+	var received int
+	for {
+		select {
+		case d := <-tickets:
+			received++
+			ticket := d.ticket
+			if !slices.Contains(d.roads, ticket.Road) {
+				return received, fmt.Errorf("ticket for road %d sent to dispatcher for roads %v", ticket.Road, d.roads)
+			}
+			key := tripKey{plate: ticket.Plate, day: ticket.Timestamp1 / 86400}
+			if err := check(ticket, trips[key], ticketed[key]); err != nil {
+				return received, err
+			}
+			ticketed[key] = true
+			if trips[key].required {
+				missing--
+			}
+			if missing == 0 && quiet == nil {
+				// The time until the last required ticket measures the throughput of the server.
+				elapsed := time.Since(start)
+				logger.Info("received required tickets", "elapsed", elapsed,
+					"observations_per_second", float64(observations(trips))/elapsed.Seconds())
+				quiet = time.After(*grace)
+			}
+		case <-quiet:
+			return received, nil
+		case <-deadline:
+			return received, fmt.Errorf("timed out with %d required tickets missing", missing)
+		}
+	}
+}
+
+func observations(trips map[tripKey]*trip) int {
+	var n int
+	for _, t := range trips {
+		n += len(t.observations)
+	}
+	return n
+}
+
+// check returns an error if a ticket does not match the trip it is for.
+func check(ticket speeddaemon.TicketMessage, t *trip, ticketed bool) error {
+	switch {
+	case t == nil:
+		return fmt.Errorf("ticket for unknown trip: %+v", ticket)
+	case ticketed:
+		return fmt.Errorf("second ticket for %s on day %d: %+v", t.plate, t.day, ticket)
+	case !t.allowed:
+		return fmt.Errorf("ticket for %s on day %d, which was not speeding: %+v", t.plate, t.day, ticket)
+	case ticket.Road != t.road.number || ticket.Timestamp2/86400 != t.day:
+		return fmt.Errorf("ticket does not match trip of %s on road %d on day %d: %+v", t.plate, t.road.number, t.day, ticket)
+	}
+
+	// Observations can arrive out of order, so the server may ticket 2 observations that were adjacent when it checked
+	// them, even if another arrived in between later.
+	first := observation{mile: ticket.Mile1, timestamp: ticket.Timestamp1}
+	second := observation{mile: ticket.Mile2, timestamp: ticket.Timestamp2}
+	i, j := slices.Index(t.observations, first), slices.Index(t.observations, second)
+	if i < 0 || j <= i {
+		return fmt.Errorf("ticket is not between observations of %s: %+v", t.plate, ticket)
+	}
+	if expected := speed(first, second) * 100; math.Abs(float64(ticket.Speed)-expected) > 100 {
+		return fmt.Errorf("ticket speed %d does not match observed speed %.0f: %+v", ticket.Speed, expected, ticket)
+	}
+	return nil
+}
+
+// startLocalServer starts a speed daemon server on a local port and returns its address and a function to stop it.
+func startLocalServer() (string, func(), error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	records := speeddaemon.NewRecordPipeline(8, 1024, 100*time.Millisecond)
+	server := &speeddaemon.SpeedLimitEnforcementServer{
+		CameraHandler:     speeddaemon.NewCameraHandler(speeddaemon.NewMemoryObservationStore(), records),
+		DispatcherHandler: speeddaemon.NewDispatcherHandler(speeddaemon.NewMemoryTicketQueue(), speeddaemon.NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           speeddaemon.NewMemoryTicketLedger(),
+	}
+	go func() { _ = server.Serve(listener) }()
+	go func() { _ = server.EnforceSpeedLimit(context.Background()) }()
+
+	stop := func() {
+		stats := records.Stats()
+		logger.Info("local server records", "submitted", stats.Submitted, "dropped", stats.Dropped)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("error shutting down local server", "err", err)
+		}
+	}
+	return listener.Addr().String(), stop, nil
+}
@@ -0,0 +1,108 @@
+package linereversal
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A client runs the peer side of a session it opened with a server.
+type client struct {
+	conn    net.PacketConn
+	addr    net.Addr
+	session *Session
+
+	connected   chan struct{}
+	connectOnce sync.Once
+}
+
+// Dial opens an LRCP session with the server at address using the default configuration.
+func Dial(address string) (net.Conn, error) {
+	return DialWithConfig(address, DefaultConfig)
+}
+
+// DialWithConfig opens an LRCP session with the server at address.
+func DialWithConfig(address string, config Config) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	return DialPacket(conn, addr, config)
+}
+
+// DialPacket opens an LRCP session with the server at addr over conn.
+//
+// The session takes ownership of conn and closes it when the session is closed.
+func DialPacket(conn net.PacketConn, addr net.Addr, config Config) (*Session, error) {
+	token := SessionToken(rand.Uint32N(MaximumNumericFieldValue))
+	c := &client{conn: conn, addr: addr, connected: make(chan struct{})}
+	c.session = newSession(token, conn, addr, config, func(*Session) {
+		if err := conn.Close(); err != nil {
+			slog.Warn("error closing packet connection", "session", token, "err", err)
+		}
+	})
+	go c.readLoop()
+
+	// The connect message is retransmitted until it is acknowledged, like any other message.
+	expiry := time.NewTimer(config.SessionExpiryTimeout)
+	defer expiry.Stop()
+	for {
+		if err := writeMessage(conn, addr, &ConnectMessage{Session: token}); err != nil {
+			_ = c.session.Close()
+			return nil, fmt.Errorf("error writing connect message: %w", err)
+		}
+
+		select {
+		case <-c.connected:
+			return c.session, nil
+		case <-c.session.closed:
+			return nil, fmt.Errorf("dial %s: %w", addr, ErrSessionClosed)
+		case <-expiry.C:
+			_ = c.session.Close()
+			return nil, fmt.Errorf("dial %s: %w", addr, os.ErrDeadlineExceeded)
+		case <-time.After(config.RetransmissionTimeout):
+		}
+	}
+}
+
+// readLoop dispatches messages from the server to the session until the session is closed.
+func (c *client) readLoop() {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.session.mu.Lock()
+			c.session.teardown()
+			c.session.mu.Unlock()
+			return
+		}
+		// Packets that are not from the server are not LRCP messages for this session.
+		if addr.String() != c.addr.String() {
+			continue
+		}
+		m, err := ParseMessage(string(buf[:n]))
+		if err != nil {
+			slog.Debug("ignoring illegal packet", "addr", addr, "err", err)
+			continue
+		}
+
+		if m.SessionID() != c.session.Token {
+			continue
+		}
+		// The server acknowledges the connect message with /ack/SESSION/0/.
+		if m.Type() == AckMessageType {
+			c.connectOnce.Do(func() { close(c.connected) })
+		}
+		if err := c.session.handleMessage(m); err != nil {
+			slog.Debug("ignoring message", "session", c.session.Token, "err", err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package linereversal
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDial(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := Listen(server)
+	defer l.Close()
+
+	// Echo everything received back to the client.
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := Dial(l.Addr().String())
+	require.NoError(t, err)
+
+	message := []byte("hello/world\\\n")
+	_, err = conn.Write(message)
+	require.NoError(t, err)
+
+	buf := make([]byte, len(message))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, message, buf)
+
+	require.NoError(t, conn.Close())
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDial_Unreachable(t *testing.T) {
+	// Nothing answers on this socket.
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	_, err = DialWithConfig(server.LocalAddr().String(), Config{
+		RetransmissionTimeout: 10 * time.Millisecond,
+		SessionExpiryTimeout:  50 * time.Millisecond,
+	})
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,69 @@
+package linereversal
+
+import (
+	"sync"
+	"time"
+)
+
+// A deadline is a point in time after which a channel is closed, so that blocked operations can select on it.
+//
+// The zero deadline never expires.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t, or clears it if t is zero.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Wait for a pending timer to close the channel, so it cannot close a replaced one.
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+
+	expired := isClosed(d.cancel)
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if remaining := time.Until(t); remaining > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(remaining, func() { close(cancel) })
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed once the deadline has passed.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -18,71 +18,244 @@ var ErrExceededMessageSize = errors.New("exceeded message size limit")
 // The peer for any given session is at a fixed IP address and port number.
 type SessionToken uint32
 
+const (
+	DefaultRetransmissionTimeout = 3 * time.Second
+	DefaultSessionExpiryTimeout  = 60 * time.Second
+)
+
+// Config holds the timeouts used by the sessions of an LRCPListener.
+type Config struct {
+	// RetransmissionTimeout is the time to wait before retransmitting a message.
+	RetransmissionTimeout time.Duration
+	// SessionExpiryTimeout is the time to wait before accepting that a peer has disappeared, in the event that no responses are being received.
+	// A session opened by a peer is also closed once nothing has been received from the peer for this long.
+	SessionExpiryTimeout time.Duration
+}
+
+// DefaultConfig uses the timeouts suggested by the LRCP specification.
+var DefaultConfig = Config{
+	RetransmissionTimeout: DefaultRetransmissionTimeout,
+	SessionExpiryTimeout:  DefaultSessionExpiryTimeout,
+}
+
+// acceptBacklog is the number of opened sessions that may wait to be accepted by the application.
+const acceptBacklog = 128
+
+// An LRCPListener serves LRCP sessions over a packet-oriented connection.
+//
+// Sessions are opened by peers and handed to the application through Accept, so an LRCPListener can be used like any
+// other net.Listener.
 type LRCPListener struct {
-	mu sync.Mutex
+	mu     sync.Mutex
+	config Config
+	conn   net.PacketConn
+
+	Sessions map[SessionToken]*Session
+	// messagesReceived counts legal messages by type.
+	messagesReceived map[MessageType]uint64
+
+	accepted  chan *Session
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen serves LRCP on conn with the default configuration.
+func Listen(conn net.PacketConn) net.Listener {
+	return ListenWithConfig(conn, DefaultConfig)
+}
+
+// ListenWithConfig serves LRCP on conn until the returned listener is closed.
+func ListenWithConfig(conn net.PacketConn, config Config) *LRCPListener {
+	l := NewLRCPListener(config)
+	l.conn = conn
+	go func() {
+		if err := l.Handle(conn); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("LRCP listener error", "addr", conn.LocalAddr(), "err", err)
+		}
+	}()
+	return l
+}
 
-	Sessions map[SessionToken]net.Addr
+func NewLRCPListener(config Config) *LRCPListener {
+	return &LRCPListener{
+		config:           config,
+		Sessions:         make(map[SessionToken]*Session),
+		messagesReceived: make(map[MessageType]uint64),
+		accepted:         make(chan *Session, acceptBacklog),
+		done:             make(chan struct{}),
+	}
 }
 
+// Handle reads LRCP messages from conn until reading fails.
 func (l *LRCPListener) Handle(conn net.PacketConn) error {
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+	defer l.closeOnce.Do(func() { close(l.done) })
+
 	buf := make([]byte, 1024)
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
-			// TODO: Should we return if an error occurs reading.
 			return err
 		}
-		// LRCP messages must be smaller than 1000 bytes.
-		if n > maximumMessageSize {
-			// TODO: Handle error.
-			slog.Error(ErrExceededMessageSize.Error())
-			return ErrExceededMessageSize
-		}
 
 		// Messages are sent in UDP packets.
 		// Each UDP packet contains a single LRCP message.
-		// TODO: When the server receives an illegal packet it must silently ignore the packet instead of interpreting it as LRCP.
+		// When the server receives an illegal packet it must silently ignore the packet instead of interpreting it as LRCP.
 		err = l.handleMessage(buf[:n], conn, addr)
+		if errors.Is(err, ErrIllegalMessage) {
+			slog.Debug("ignoring illegal packet", "addr", addr, "err", err)
+		} else if err != nil {
+			slog.Error("error handling message", "addr", addr, "err", err)
+		}
 	}
 }
 
-const (
-	DefaultRetransmissionTimeout = 3 * time.Second
-	DefaultSessionExpiryTimeout  = 60 * time.Second
-)
+// Accept waits for and returns the next session opened by a peer.
+//
+// The returned net.Conn is a *Session.
+func (l *LRCPListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accepted:
+		return s, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
 
-// TODO: Make these parameters / configurable.
-var (
-	// RetransmissionTimeout is the time to wait before retransmitting a message.
-	RetransmissionTimeout = DefaultRetransmissionTimeout
-	// SessionExpiryTimeout is the time to wait before accepting that a peer has disappeared, in the event that no responses are being received.
-	SessionExpiryTimeout = DefaultSessionExpiryTimeout
-)
+// Close closes every open session and stops serving LRCP.
+func (l *LRCPListener) Close() error {
+	l.mu.Lock()
+	sessions := make([]*Session, 0, len(l.Sessions))
+	for _, s := range l.Sessions {
+		sessions = append(sessions, s)
+	}
+	conn := l.conn
+	l.mu.Unlock()
+
+	for _, s := range sessions {
+		if err := s.Close(); err != nil {
+			slog.Warn("error closing session", "session", s.Token, "err", err)
+		}
+	}
+
+	l.closeOnce.Do(func() { close(l.done) })
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Addr returns the local address LRCP is served on.
+func (l *LRCPListener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+	return l.conn.LocalAddr()
+}
 
 func (l *LRCPListener) handleMessage(buf []byte, conn net.PacketConn, addr net.Addr) error {
-	// When the server receives an illegal packet, it must silently ignore the packet instead of interpreting it as LRCP.
 	m, err := ParseMessage(string(buf))
 	if err != nil {
 		return err
 	}
+	slog.Debug("received message", "type", m.Type(), "session", m.SessionID(), "addr", addr)
 
-	fmt.Println(m)
+	l.mu.Lock()
+	l.messagesReceived[m.Type()]++
+	l.mu.Unlock()
 
+	if c, ok := m.(*ConnectMessage); ok {
+		l.handleConnectMessage(c, conn, addr)
+		return nil
+	}
+	if s := l.session(m.SessionID(), conn, addr); s != nil {
+		return s.handleMessage(m)
+	}
 	return nil
 }
 
-const connectionAck = "/ack/SESSION/0/"
+func (l *LRCPListener) handleConnectMessage(m *ConnectMessage, conn net.PacketConn, addr net.Addr) {
+	s, opened := l.open(m, conn, addr)
+	if s == nil {
+		return
+	}
+	// The session is watched and touched outside l.mu, as a session holds its own lock while it is released.
+	if opened {
+		s.watchSilence()
+	} else if s.addr.String() == addr.String() {
+		s.touch()
+	}
+
+	// Send /ack/SESSION/0/ regardless.
+	s.send(&AckMessage{Session: m.Session})
+}
 
-func (l *LRCPListener) handleConnectMessage(m *ConnectMessage, conn net.PacketConn, addr net.Addr) error {
+// open returns the session for a connect message, opening it if needed, and reports whether it was opened. It returns
+// nil if the accept backlog is full.
+func (l *LRCPListener) open(m *ConnectMessage, conn net.PacketConn, addr net.Addr) (*Session, bool) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	// If no session with this token is open: open one, and associate it with the IP address and port number that the UDP packet originated from.
-	_, ok := l.Sessions[m.Session]
+	if s, ok := l.Sessions[m.Session]; ok {
+		return s, false
+	}
+	s := newSession(m.Session, conn, addr, l.config, l.release)
+	select {
+	case l.accepted <- s:
+	default:
+		// The application is not keeping up; the peer will retry its connect message.
+		slog.Warn("accept backlog full, ignoring connect", "session", m.Session, "addr", addr)
+		return nil, false
+	}
+	l.Sessions[m.Session] = s
+	slog.Debug("session opened", "session", m.Session, "addr", addr)
+	return s, true
+}
+
+// session returns the open session for token, or nil if there is none.
+//
+// If no session with this token is open, the peer is told to close it.
+func (l *LRCPListener) session(token SessionToken, conn net.PacketConn, addr net.Addr) *Session {
+	l.mu.Lock()
+	s, ok := l.Sessions[token]
+	l.mu.Unlock()
+
 	if !ok {
-		l.Sessions[m.Session] = addr
+		if err := writeMessage(conn, addr, &CloseMessage{Session: token}); err != nil {
+			slog.Warn("error writing close message", "session", token, "err", err)
+		}
+		return nil
+	}
+	// The peer for any given session is at a fixed IP address and port number.
+	if s.addr.String() != addr.String() {
+		slog.Debug("ignoring message from unexpected peer", "session", token, "addr", addr)
+		return nil
 	}
+	return s
+}
 
-	_, err := conn.WriteTo([]byte(connectionAck), addr)
+func (l *LRCPListener) release(s *Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Sessions[s.Token] == s {
+		delete(l.Sessions, s.Token)
+	}
+	slog.Debug("session closed", "session", s.Token)
+}
+
+// writeMessage encodes a message and sends it to addr in a single packet.
+func writeMessage(conn net.PacketConn, addr net.Addr, m Message) error {
+	b, err := m.MarshalText()
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+	_, err = conn.WriteTo(b, addr)
 	return err
 }
@@ -0,0 +1,306 @@
+package linereversal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startListener serves an LRCPListener on a loopback UDP socket and returns a peer socket and the listener address.
+func startListener(t *testing.T) (*LRCPListener, net.PacketConn, net.Addr) {
+	t.Helper()
+	return startListenerWithConfig(t, DefaultConfig)
+}
+
+func startListenerWithConfig(t *testing.T, config Config) (*LRCPListener, net.PacketConn, net.Addr) {
+	t.Helper()
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+
+	l := NewLRCPListener(config)
+	go l.Handle(server)
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+
+	return l, peer, server.LocalAddr()
+}
+
+func accept(t *testing.T, l *LRCPListener) *Session {
+	t.Helper()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	return conn.(*Session)
+}
+
+func exchange(t *testing.T, peer net.PacketConn, addr net.Addr, m string) string {
+	t.Helper()
+
+	_, err := peer.WriteTo([]byte(m), addr)
+	require.NoError(t, err)
+	return receive(t, peer)
+}
+
+func receive(t *testing.T, peer net.PacketConn) string {
+	t.Helper()
+
+	buf := make([]byte, 1024)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := peer.ReadFrom(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestLRCPListener_Session(t *testing.T) {
+	l, peer, addr := startListener(t)
+
+	assert.Equal(t, "/ack/12345/0/", exchange(t, peer, addr, "/connect/12345/"))
+	// Connecting again is acknowledged without opening another session.
+	assert.Equal(t, "/ack/12345/0/", exchange(t, peer, addr, "/connect/12345/"))
+
+	s := accept(t, l)
+	assert.Equal(t, SessionToken(12345), s.Token)
+
+	assert.Equal(t, "/ack/12345/6/", exchange(t, peer, addr, `/data/12345/0/hello\//`))
+	// Data beyond what has been received is buffered and the previous ack is repeated.
+	assert.Equal(t, "/ack/12345/6/", exchange(t, peer, addr, "/data/12345/8/d\n/"))
+	assert.Equal(t, "/ack/12345/10/", exchange(t, peer, addr, `/data/12345/5/\/wo/`))
+	// Duplicate data is acknowledged but not delivered twice.
+	assert.Equal(t, "/ack/12345/10/", exchange(t, peer, addr, "/data/12345/0/hello/"))
+
+	buf := make([]byte, 64)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello/wod\n", string(buf[:n]))
+
+	_, err = s.Write([]byte(`ok\`))
+	require.NoError(t, err)
+	assert.Equal(t, `/data/12345/0/ok\\/`, receive(t, peer))
+
+	// A partial ack causes the remaining data to be retransmitted.
+	assert.Equal(t, `/data/12345/2/\\/`, exchange(t, peer, addr, "/ack/12345/2/"))
+
+	assert.Equal(t, "/close/12345/", exchange(t, peer, addr, "/close/12345/"))
+	_, err = s.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	// Messages for a session that is not open are answered with a close message.
+	assert.Equal(t, "/close/12345/", exchange(t, peer, addr, "/data/12345/10/x/"))
+}
+
+func TestLRCPListener_MisbehavingPeer(t *testing.T) {
+	l, peer, addr := startListener(t)
+
+	assert.Equal(t, "/ack/1/0/", exchange(t, peer, addr, "/connect/1/"))
+	s := accept(t, l)
+
+	_, err := s.Write([]byte("hi"))
+	require.NoError(t, err)
+	assert.Equal(t, "/data/1/0/hi/", receive(t, peer))
+
+	// Acknowledging more than has been sent closes the session.
+	assert.Equal(t, "/close/1/", exchange(t, peer, addr, "/ack/1/3/"))
+	_, err = s.Write([]byte("again"))
+	assert.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func TestLRCPListener_IgnoresIllegalPackets(t *testing.T) {
+	_, peer, addr := startListener(t)
+
+	for _, m := range []string{"", "/connect/", "connect/1/", "/connect/1", "/bogus/1/", "/ack/1/", string(make([]byte, 1000))} {
+		_, err := peer.WriteTo([]byte(m), addr)
+		require.NoError(t, err)
+	}
+
+	// Only the legal message is answered.
+	assert.Equal(t, "/ack/2/0/", exchange(t, peer, addr, "/connect/2/"))
+}
+
+func TestSession_TransmitSplitsLargeWrites(t *testing.T) {
+	l, peer, addr := startListener(t)
+
+	assert.Equal(t, "/ack/7/0/", exchange(t, peer, addr, "/connect/7/"))
+	s := accept(t, l)
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = '/'
+	}
+	_, err := s.Write(data)
+	require.NoError(t, err)
+
+	var received int
+	for received < len(data) {
+		m := receive(t, peer)
+		assert.Less(t, len(m), maximumMessageSize)
+
+		parsed, err := ParseMessage(m)
+		require.NoError(t, err)
+		d := parsed.(*DataMessage)
+		assert.Equal(t, uint32(received), d.Pos)
+		received += len(d.Data)
+	}
+	assert.Equal(t, len(data), received)
+}
+
+func TestSession_Retransmission(t *testing.T) {
+	l, peer, addr := startListenerWithConfig(t, Config{
+		RetransmissionTimeout: 20 * time.Millisecond,
+		SessionExpiryTimeout:  time.Second,
+	})
+
+	assert.Equal(t, "/ack/3/0/", exchange(t, peer, addr, "/connect/3/"))
+	s := accept(t, l)
+
+	_, err := s.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "/data/3/0/abc/", receive(t, peer))
+	// Unacknowledged data is retransmitted after the retransmission timeout.
+	assert.Equal(t, "/data/3/0/abc/", receive(t, peer))
+
+	// Only the unacknowledged part is retransmitted after a partial ack.
+	_, err = peer.WriteTo([]byte("/ack/3/1/"), addr)
+	require.NoError(t, err)
+	for m := receive(t, peer); m != "/data/3/1/bc/"; m = receive(t, peer) {
+		assert.Equal(t, "/data/3/0/abc/", m)
+	}
+	assert.Equal(t, "/data/3/1/bc/", receive(t, peer))
+
+	// Nothing is retransmitted once everything has been acknowledged.
+	_, err = peer.WriteTo([]byte("/ack/3/3/"), addr)
+	require.NoError(t, err)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	buf := make([]byte, 1024)
+	for {
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		assert.Equal(t, "/data/3/1/bc/", string(buf[:n]))
+	}
+}
+
+func TestSession_Expiry(t *testing.T) {
+	l, peer, addr := startListenerWithConfig(t, Config{
+		RetransmissionTimeout: 10 * time.Millisecond,
+		SessionExpiryTimeout:  50 * time.Millisecond,
+	})
+
+	assert.Equal(t, "/ack/4/0/", exchange(t, peer, addr, "/connect/4/"))
+	s := accept(t, l)
+
+	_, err := s.Write([]byte("anyone there?"))
+	require.NoError(t, err)
+
+	// The session expires when the peer never acknowledges the data.
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	l.mu.Lock()
+	assert.NotContains(t, l.Sessions, SessionToken(4))
+	l.mu.Unlock()
+}
+
+func TestSession_ExpiryAfterSilence(t *testing.T) {
+	l, peer, addr := startListenerWithConfig(t, Config{
+		RetransmissionTimeout: 10 * time.Millisecond,
+		SessionExpiryTimeout:  50 * time.Millisecond,
+	})
+
+	assert.Equal(t, "/ack/6/0/", exchange(t, peer, addr, "/connect/6/"))
+	s := accept(t, l)
+
+	// The session stays open while the peer keeps sending, even though nothing is written to it.
+	for i := range 5 {
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, fmt.Sprintf("/ack/6/%d/", i+1), exchange(t, peer, addr, fmt.Sprintf("/data/6/%d/a/", i)))
+	}
+	assert.False(t, s.isClosed())
+
+	// The peer goes silent without completing a line, so the session expires.
+	_, err := io.ReadFull(s, make([]byte, 5))
+	require.NoError(t, err)
+	require.NoError(t, s.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = s.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	l.mu.Lock()
+	assert.NotContains(t, l.Sessions, SessionToken(6))
+	l.mu.Unlock()
+}
+
+func TestListen(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := Listen(server)
+	assert.Equal(t, server.LocalAddr(), l.Addr())
+
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	assert.Equal(t, "/ack/5/0/", exchange(t, peer, l.Addr(), "/connect/5/"))
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	assert.Equal(t, peer.LocalAddr().String(), conn.RemoteAddr().String())
+
+	// Reads time out like they would on any other net.Conn.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = conn.Read(make([]byte, 8))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	assert.Equal(t, "/ack/5/6/", exchange(t, peer, l.Addr(), "/data/5/0/hello\n/"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+
+	// Closing the listener closes its sessions.
+	require.NoError(t, l.Close())
+	assert.Equal(t, "/close/5/", receive(t, peer))
+	_, err = conn.Write([]byte("bye"))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestLRCPListener_Stats(t *testing.T) {
+	l, peer, addr := startListenerWithConfig(t, Config{
+		RetransmissionTimeout: time.Hour,
+		SessionExpiryTimeout:  time.Hour,
+	})
+
+	assert.Equal(t, "/ack/8/0/", exchange(t, peer, addr, "/connect/8/"))
+	s := accept(t, l)
+	assert.Equal(t, "/ack/8/5/", exchange(t, peer, addr, "/data/8/0/hello/"))
+
+	_, err := s.Write([]byte("olleh"))
+	require.NoError(t, err)
+	assert.Equal(t, "/data/8/0/olleh/", receive(t, peer))
+	assert.Equal(t, "/data/8/2/leh/", exchange(t, peer, addr, "/ack/8/2/"))
+
+	stats := l.Stats()
+	assert.Equal(t, 1, stats.OpenSessions)
+	assert.Equal(t, map[MessageType]uint64{ConnectMessageType: 1, DataMessageType: 1, AckMessageType: 1}, stats.MessagesReceived)
+	require.Len(t, stats.Sessions, 1)
+
+	session := stats.Sessions[0]
+	assert.Equal(t, SessionToken(8), session.Session)
+	assert.Equal(t, peer.LocalAddr().String(), session.Addr)
+	assert.Equal(t, uint32(5), session.BytesReceived)
+	assert.Equal(t, uint32(5), session.BytesSent)
+	assert.Equal(t, uint32(2), session.BytesAcked)
+	assert.Equal(t, uint64(1), session.Retransmissions)
+	assert.Positive(t, session.Age)
+}
@@ -1,15 +1,46 @@
 package linereversal
 
 import (
+	"encoding"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 )
 
-type Message interface{}
+// A Message is a single LRCP message, sent in its own UDP packet.
+type Message interface {
+	// SessionID returns the token of the session the message belongs to.
+	SessionID() SessionToken
+	// Type returns the type of the message, as given by its first field.
+	Type() MessageType
+	encoding.TextMarshaler
+}
+
+type MessageType string
+
+const (
+	ConnectMessageType MessageType = "connect"
+	DataMessageType    MessageType = "data"
+	AckMessageType     MessageType = "ack"
+	CloseMessageType   MessageType = "close"
+)
 
 const MessageSeparator = "/"
 
+// ErrIllegalMessage is wrapped by every error returned for a packet that is not a legal LRCP message.
+//
+// Illegal packets must be silently ignored rather than interpreted as LRCP.
+var ErrIllegalMessage = errors.New("illegal message")
+
+var (
+	ErrInvalidFraming      = fmt.Errorf("%w: must begin and end with an unescaped forward slash", ErrIllegalMessage)
+	ErrInvalidEscape       = fmt.Errorf("%w: invalid escape sequence", ErrIllegalMessage)
+	ErrUnknownMessageType  = fmt.Errorf("%w: unknown message type", ErrIllegalMessage)
+	ErrInvalidFieldCount   = fmt.Errorf("%w: wrong number of fields", ErrIllegalMessage)
+	ErrInvalidNumericField = fmt.Errorf("%w: invalid numeric field", ErrIllegalMessage)
+)
+
 // ParseMessage parses and validates a LRCP message.
 //
 // Each message consists of a series of values separated by forward slash characters ("/"), and starts and ends with a
@@ -19,59 +50,96 @@ const MessageSeparator = "/"
 //
 // The first field is a string specifying the message type (here, "data").
 // The remaining fields depend on the message type. Numeric fields are represented as ASCII text.
+//
+// Every error returned for an illegal message wraps ErrIllegalMessage.
 func ParseMessage(s string) (Message, error) {
+	// LRCP messages must be smaller than 1000 bytes.
+	if len(s) >= maximumMessageSize {
+		return nil, fmt.Errorf("%w: %w", ErrIllegalMessage, ErrExceededMessageSize)
+	}
 	// Packet contents must begin with a forward slash and end with a forward slash.
 	if !strings.HasPrefix(s, MessageSeparator) {
-		return nil, fmt.Errorf("invalid message: must begin with forward slash")
+		return nil, ErrInvalidFraming
 	}
-	if !strings.HasSuffix(s, MessageSeparator) {
-		return nil, fmt.Errorf("invalid message: must end with forward slash")
-	}
-
-	s = strings.TrimSuffix(strings.TrimPrefix(s, MessageSeparator), MessageSeparator)
 
-	fields := SplitEscaped(s, '/', '\\')
+	fields, err := SplitEscaped(s[1:], '/', '\\')
+	if err != nil {
+		return nil, err
+	}
+	// The closing forward slash leaves an empty field at the end; anything else means the message is unterminated,
+	// for example because its last forward slash is escaped.
+	if len(fields) < 2 || fields[len(fields)-1] != "" {
+		return nil, ErrInvalidFraming
+	}
+	fields = fields[:len(fields)-1]
 
-	messageType := fields[0]
+	messageType := MessageType(fields[0])
 	switch messageType {
-	case "connect":
+	case ConnectMessageType:
 		return parseConnectMessage(fields[1:])
-	case "data":
+	case DataMessageType:
 		return parseDataMessage(fields[1:])
-	case "ack":
+	case AckMessageType:
 		return parseAckMessage(fields[1:])
-	case "close":
+	case CloseMessageType:
 		return parseCloseMessage(fields[1:])
 	default:
-		return nil, fmt.Errorf("invalid message: unknown message type: %s", messageType)
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMessageType, messageType)
 	}
 }
 
-func SplitEscaped(s string, sep, escape rune) []string {
+// marshalMessage encodes the fields of a message, starting and ending it with a forward slash.
+func marshalMessage(t MessageType, fields ...string) ([]byte, error) {
+	b := []byte(MessageSeparator + strings.Join(append([]string{string(t)}, fields...), MessageSeparator) + MessageSeparator)
+	// LRCP messages must be smaller than 1000 bytes.
+	if len(b) >= maximumMessageSize {
+		return nil, ErrExceededMessageSize
+	}
+	return b, nil
+}
+
+// escape escapes forward slash and backslash characters in payload data with a preceding backslash.
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `/`, `\/`)
+
+// SplitEscaped splits s at every sep that is not preceded by escape, and unescapes the fields.
+//
+// Only sep and escape itself may be escaped, so any other escape sequence, or a trailing lone escape, is an error.
+func SplitEscaped(s string, sep, escape byte) ([]string, error) {
 	var fields []string
-	var current []rune
+	var current []byte
 	escaped := false
 
-	for _, r := range s {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
 		if escaped {
-			current = append(current, r)
+			if c != sep && c != escape {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidEscape, []byte{escape, c})
+			}
+			current = append(current, c)
 			escaped = false
 			continue
 		}
-		if r == escape {
+		if c == escape {
 			escaped = true
 			continue
 		}
-		if r == sep {
+		if c == sep {
 			fields = append(fields, string(current))
 			current = nil
 			continue
 		}
-		current = append(current, r)
+		current = append(current, c)
+	}
+	if escaped {
+		return nil, fmt.Errorf("%w: trailing %q", ErrInvalidEscape, escape)
 	}
 
 	fields = append(fields, string(current))
-	return fields
+	return fields, nil
 }
 
 // A ConnectMessage is sent by a client, to a server, to request that a session is opened.
@@ -79,9 +147,12 @@ type ConnectMessage struct {
 	Session SessionToken
 }
 
+func (m *ConnectMessage) SessionID() SessionToken { return m.Session }
+func (m *ConnectMessage) Type() MessageType       { return ConnectMessageType }
+
 func parseConnectMessage(fields []string) (*ConnectMessage, error) {
 	if len(fields) != 1 {
-		return nil, fmt.Errorf("invalid message: connect message must contain one field")
+		return nil, fmt.Errorf("%w: connect message must contain one field", ErrInvalidFieldCount)
 	}
 	session, err := parseNumericField(fields[0])
 	if err != nil {
@@ -90,6 +161,14 @@ func parseConnectMessage(fields []string) (*ConnectMessage, error) {
 	return &ConnectMessage{Session: SessionToken(session)}, nil
 }
 
+func (m *ConnectMessage) MarshalText() ([]byte, error) {
+	session, err := marshalNumericField(uint32(m.Session))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling SESSION: %w", err)
+	}
+	return marshalMessage(ConnectMessageType, session)
+}
+
 // A DataMessage transmits payload data.
 type DataMessage struct {
 	Session SessionToken
@@ -98,9 +177,12 @@ type DataMessage struct {
 	Data string
 }
 
+func (m *DataMessage) SessionID() SessionToken { return m.Session }
+func (m *DataMessage) Type() MessageType       { return DataMessageType }
+
 func parseDataMessage(fields []string) (*DataMessage, error) {
 	if len(fields) != 3 {
-		return nil, fmt.Errorf("invalid message: data message must contain three fields")
+		return nil, fmt.Errorf("%w: data message must contain three fields", ErrInvalidFieldCount)
 	}
 
 	m := &DataMessage{}
@@ -117,10 +199,58 @@ func parseDataMessage(fields []string) (*DataMessage, error) {
 	m.Pos = position
 
 	m.Data = fields[2]
+	// Sessions are limited to 2 billion bytes of data transferred in each direction.
+	if uint64(m.Pos)+uint64(len(m.Data)) >= MaximumNumericFieldValue {
+		return nil, fmt.Errorf("%w: data extends beyond 2147483648 bytes", ErrInvalidNumericField)
+	}
 
 	return m, nil
 }
 
+// MarshalText encodes the message, escaping forward slash and backslash characters in Data.
+func (m *DataMessage) MarshalText() ([]byte, error) {
+	session, err := marshalNumericField(uint32(m.Session))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling SESSION: %w", err)
+	}
+	position, err := marshalNumericField(m.Pos)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling POS: %w", err)
+	}
+	if uint64(m.Pos)+uint64(len(m.Data)) >= MaximumNumericFieldValue {
+		return nil, fmt.Errorf("data extends beyond 2147483648 bytes")
+	}
+	return marshalMessage(DataMessageType, session, position, escape(m.Data))
+}
+
+// SplitData splits payload data at pos into as many data messages as needed for each to stay within the maximum
+// message size once escaped.
+func SplitData(session SessionToken, pos uint32, data []byte) []*DataMessage {
+	var messages []*DataMessage
+	for len(data) > 0 {
+		// Everything but the data itself must fit in the message as well.
+		overhead := len(fmt.Sprintf("/data/%d/%d//", session, pos))
+		n, escapedLength := 0, 0
+		for n < len(data) {
+			l := 1
+			if data[n] == '/' || data[n] == '\\' {
+				l = 2
+			}
+			if overhead+escapedLength+l >= maximumMessageSize {
+				break
+			}
+			escapedLength += l
+			n++
+		}
+
+		messages = append(messages, &DataMessage{Session: session, Pos: pos, Data: string(data[:n])})
+		// Pos refers to unescaped bytes, so it advances by the length of the data before escaping.
+		pos += uint32(n)
+		data = data[n:]
+	}
+	return messages
+}
+
 // An AckMessage acknowledges receipt of payload data.
 type AckMessage struct {
 	Session SessionToken
@@ -128,9 +258,12 @@ type AckMessage struct {
 	Length uint32
 }
 
+func (m *AckMessage) SessionID() SessionToken { return m.Session }
+func (m *AckMessage) Type() MessageType       { return AckMessageType }
+
 func parseAckMessage(fields []string) (*AckMessage, error) {
 	if len(fields) != 2 {
-		return nil, fmt.Errorf("invalid message: ack message must contain two fields")
+		return nil, fmt.Errorf("%w: ack message must contain two fields", ErrInvalidFieldCount)
 	}
 
 	m := &AckMessage{}
@@ -149,15 +282,30 @@ func parseAckMessage(fields []string) (*AckMessage, error) {
 	return m, nil
 }
 
+func (m *AckMessage) MarshalText() ([]byte, error) {
+	session, err := marshalNumericField(uint32(m.Session))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling SESSION: %w", err)
+	}
+	length, err := marshalNumericField(m.Length)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling LENGTH: %w", err)
+	}
+	return marshalMessage(AckMessageType, session, length)
+}
+
 // A CloseMessage requests that the session is closed.
 // This can be initiated by either the server or the client.
 type CloseMessage struct {
 	Session SessionToken
 }
 
+func (m *CloseMessage) SessionID() SessionToken { return m.Session }
+func (m *CloseMessage) Type() MessageType       { return CloseMessageType }
+
 func parseCloseMessage(fields []string) (*CloseMessage, error) {
 	if len(fields) != 1 {
-		return nil, fmt.Errorf("invalid message: close message must contain one field")
+		return nil, fmt.Errorf("%w: close message must contain one field", ErrInvalidFieldCount)
 	}
 	session, err := parseNumericField(fields[0])
 	if err != nil {
@@ -166,19 +314,41 @@ func parseCloseMessage(fields []string) (*CloseMessage, error) {
 	return &CloseMessage{Session: SessionToken(session)}, nil
 }
 
+func (m *CloseMessage) MarshalText() ([]byte, error) {
+	session, err := marshalNumericField(uint32(m.Session))
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling SESSION: %w", err)
+	}
+	return marshalMessage(CloseMessageType, session)
+}
+
 // MaximumNumericFieldValue is the maximum numeric field value.
 //
 // Numeric field values must be smaller than 2,147,483,648.
 // This means sessions are limited to 2 billion bytes of data transferred in each direction.
 const MaximumNumericFieldValue = 2_147_483_648
 
+// parseNumericField parses a non-negative integer represented as ASCII digits.
 func parseNumericField(s string) (uint32, error) {
-	u, err := strconv.ParseUint(s, 10, 32)
-	if err != nil {
-		return 0, fmt.Errorf("invalid numeric field value: %w", err)
+	if s == "" {
+		return 0, fmt.Errorf("%w: empty", ErrInvalidNumericField)
 	}
-	if u > MaximumNumericFieldValue {
-		return 0, fmt.Errorf("numeric field values must be smaller than 2147483648")
+	var u uint64
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidNumericField, s)
+		}
+		u = u*10 + uint64(s[i]-'0')
+		if u >= MaximumNumericFieldValue {
+			return 0, fmt.Errorf("%w: numeric field values must be smaller than 2147483648", ErrInvalidNumericField)
+		}
 	}
 	return uint32(u), nil
 }
+
+func marshalNumericField(u uint32) (string, error) {
+	if u >= MaximumNumericFieldValue {
+		return "", fmt.Errorf("numeric field values must be smaller than 2147483648")
+	}
+	return strconv.FormatUint(uint64(u), 10), nil
+}
@@ -1,6 +1,7 @@
 package linereversal
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,3 +37,140 @@ func TestParseMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestMessage_MarshalText(t *testing.T) {
+	tests := map[string]struct {
+		m           Message
+		messageType MessageType
+		expected    string
+	}{
+		"connect": {
+			m:           &ConnectMessage{Session: 1234567},
+			messageType: ConnectMessageType,
+			expected:    "/connect/1234567/",
+		},
+		"data": {
+			m:           &DataMessage{1234567, 0, "hello"},
+			messageType: DataMessageType,
+			expected:    "/data/1234567/0/hello/",
+		},
+		"escaped data": {
+			m:           &DataMessage{1234567, 3, `foo/bar\baz`},
+			messageType: DataMessageType,
+			expected:    `/data/1234567/3/foo\/bar\\baz/`,
+		},
+		"ack": {
+			m:           &AckMessage{1234567, 1024},
+			messageType: AckMessageType,
+			expected:    "/ack/1234567/1024/",
+		},
+		"close": {
+			m:           &CloseMessage{1234567},
+			messageType: CloseMessageType,
+			expected:    "/close/1234567/",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			text, err := test.m.MarshalText()
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(text))
+
+			parsed, err := ParseMessage(string(text))
+			assert.NoError(t, err)
+			assert.Equal(t, test.m, parsed)
+			assert.Equal(t, SessionToken(1234567), parsed.SessionID())
+			assert.Equal(t, test.messageType, parsed.Type())
+		})
+	}
+}
+
+func TestMessage_MarshalTextInvalid(t *testing.T) {
+	_, err := (&AckMessage{Session: 1, Length: MaximumNumericFieldValue}).MarshalText()
+	assert.Error(t, err)
+
+	_, err = (&DataMessage{Session: 1, Data: strings.Repeat("/", 500)}).MarshalText()
+	assert.ErrorIs(t, err, ErrExceededMessageSize)
+}
+
+func TestSplitData(t *testing.T) {
+	data := []byte(strings.Repeat(`a/b\`, 1000))
+
+	messages := SplitData(1234567, 10, data)
+	assert.Greater(t, len(messages), 1)
+
+	var reassembled []byte
+	for _, m := range messages {
+		assert.Equal(t, uint32(10+len(reassembled)), m.Pos)
+
+		text, err := m.MarshalText()
+		assert.NoError(t, err)
+		assert.Less(t, len(text), maximumMessageSize)
+
+		reassembled = append(reassembled, m.Data...)
+	}
+	assert.Equal(t, data, reassembled)
+}
+
+func TestParseMessage_Illegal(t *testing.T) {
+	tests := map[string]struct {
+		m        string
+		expected error
+	}{
+		"empty":                    {m: "", expected: ErrInvalidFraming},
+		"no leading slash":         {m: "connect/1/", expected: ErrInvalidFraming},
+		"no trailing slash":        {m: "/connect/1", expected: ErrInvalidFraming},
+		"escaped trailing slash":   {m: `/data/1/0/hello\/`, expected: ErrInvalidFraming},
+		"single slash":             {m: "/", expected: ErrInvalidFraming},
+		"unknown type":             {m: "/open/1/", expected: ErrUnknownMessageType},
+		"too few fields":           {m: "/ack/1/", expected: ErrInvalidFieldCount},
+		"too many fields":          {m: "/close/1/2/", expected: ErrInvalidFieldCount},
+		"unescaped slash in data":  {m: "/data/1/0/a/b/", expected: ErrInvalidFieldCount},
+		"invalid escape":           {m: `/data/1/0/a\nb/`, expected: ErrInvalidEscape},
+		"trailing backslash":       {m: `/data/1/0/\`, expected: ErrInvalidEscape},
+		"maximum session":          {m: "/connect/2147483648/", expected: ErrInvalidNumericField},
+		"overflowing session":      {m: "/connect/4294967296/", expected: ErrInvalidNumericField},
+		"negative length":          {m: "/ack/1/-1/", expected: ErrInvalidNumericField},
+		"signed session":           {m: "/connect/+1/", expected: ErrInvalidNumericField},
+		"empty position":           {m: "/data/1//x/", expected: ErrInvalidNumericField},
+		"data beyond stream limit": {m: "/data/1/2147483647/x/", expected: ErrInvalidNumericField},
+		"too large":                {m: "/data/1/0/" + strings.Repeat("a", 990) + "/", expected: ErrExceededMessageSize},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseMessage(test.m)
+			assert.ErrorIs(t, err, test.expected)
+			assert.ErrorIs(t, err, ErrIllegalMessage)
+		})
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	for _, m := range []string{
+		"/connect/1234567/",
+		"/data/1234567/0/hello/",
+		`/data/1234567/5/foo\/bar\\baz/`,
+		"/ack/1234567/1024/",
+		"/close/1234567/",
+		`/data/1/0/\`,
+		"/data/1/0/a/b/",
+	} {
+		f.Add(m)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		m, err := ParseMessage(s)
+		if err != nil {
+			// Every rejected packet is one the listener silently ignores.
+			assert.ErrorIs(t, err, ErrIllegalMessage)
+			return
+		}
+
+		// Every legal message can be encoded and parsed back.
+		text, err := m.MarshalText()
+		assert.NoError(t, err)
+		parsed, err := ParseMessage(string(text))
+		assert.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	})
+}
@@ -0,0 +1,394 @@
+package linereversal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrSessionClosed = fmt.Errorf("session closed: %w", net.ErrClosed)
+
+// maximumPendingSegments bounds the out-of-order payload data buffered for a session.
+const maximumPendingSegments = 64
+
+// A Session is an LRCP session with a single peer.
+//
+// Payload data received from the peer is read in order with Read.
+// Payload data written with Write is sent to the peer and retransmitted until it is acknowledged.
+// A Session implements net.Conn, so applications written against TCP can be served over LRCP unchanged.
+type Session struct {
+	mu sync.Mutex
+
+	Token  SessionToken
+	conn   net.PacketConn
+	addr   net.Addr
+	config Config
+
+	// received is the amount of contiguous payload data received from the peer.
+	received uint32
+	// pending holds payload data received ahead of a gap, keyed by position, until the gap is filled.
+	pending map[uint32]string
+	// inbound holds received payload data that has not yet been read by the application.
+	inbound      bytes.Buffer
+	readable     chan struct{}
+	readDeadline *deadline
+
+	// sent is the total amount of payload data written by the application.
+	sent uint32
+	// acked is the largest LENGTH acknowledged by the peer.
+	acked uint32
+	// unacked holds the payload data after the first acked bytes.
+	unacked []byte
+	// retransmission fires while there is unacknowledged payload data.
+	retransmission *time.Timer
+	// waitingSince is when the peer last acknowledged new payload data, or when data became outstanding.
+	waitingSince  time.Time
+	writeDeadline *deadline
+	// retransmissions is the number of data messages sent again because they were not acknowledged.
+	retransmissions uint64
+
+	// lastReceived is when a message was last received from the peer.
+	lastReceived time.Time
+	// silence fires when the peer may have been silent for the session expiry timeout.
+	silence *time.Timer
+
+	opened    time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func(*Session)
+}
+
+func newSession(token SessionToken, conn net.PacketConn, addr net.Addr, config Config, onClose func(*Session)) *Session {
+	return &Session{
+		Token:         token,
+		conn:          conn,
+		addr:          addr,
+		config:        config,
+		pending:       make(map[uint32]string),
+		readable:      make(chan struct{}, 1),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		opened:        time.Now(),
+		lastReceived:  time.Now(),
+		closed:        make(chan struct{}),
+		onClose:       onClose,
+	}
+}
+
+// Read reads payload data received from the peer.
+//
+// Once the session is closed and all received data has been read, Read returns io.EOF.
+func (s *Session) Read(p []byte) (int, error) {
+	for {
+		if isClosed(s.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		s.mu.Lock()
+		if s.inbound.Len() > 0 {
+			n, err := s.inbound.Read(p)
+			s.mu.Unlock()
+			return n, err
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.readable:
+		case <-s.readDeadline.wait():
+		case <-s.closed:
+			// Data may have arrived right before the session was closed.
+			s.mu.Lock()
+			n, _ := s.inbound.Read(p)
+			s.mu.Unlock()
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write sends payload data to the peer.
+//
+// Write does not wait for the data to be acknowledged.
+func (s *Session) Write(p []byte) (int, error) {
+	if isClosed(s.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return 0, ErrSessionClosed
+	}
+	if uint64(s.sent)+uint64(len(p)) >= MaximumNumericFieldValue {
+		return 0, fmt.Errorf("session %d: exceeded maximum stream length", s.Token)
+	}
+
+	pos := s.sent
+	s.unacked = append(s.unacked, p...)
+	s.sent += uint32(len(p))
+	s.transmit(pos, p)
+	s.scheduleRetransmission()
+	return len(p), nil
+}
+
+// Close closes the session and tells the peer to do the same.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return nil
+	}
+	s.send(&CloseMessage{Session: s.Token})
+	s.teardown()
+	return nil
+}
+
+// LocalAddr returns the local address of the packet connection the session is served on.
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+func (s *Session) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+// handleMessage applies a message from the peer to the session.
+func (s *Session) handleMessage(m Message) error {
+	s.touch()
+	switch m := m.(type) {
+	case *DataMessage:
+		s.handleData(m)
+	case *AckMessage:
+		s.handleAck(m)
+	case *CloseMessage:
+		s.handleClose()
+	default:
+		return fmt.Errorf("unexpected %s message for open session %d", m.Type(), m.SessionID())
+	}
+	return nil
+}
+
+func (s *Session) handleData(m *DataMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case m.Pos <= s.received:
+		s.receive(m.Pos, m.Data)
+		s.receivePending()
+	case len(s.pending) < maximumPendingSegments:
+		// Keep data received ahead of a gap so it does not need to be retransmitted.
+		if len(m.Data) > len(s.pending[m.Pos]) {
+			s.pending[m.Pos] = m.Data
+		}
+	}
+
+	// Acknowledge everything received so far.
+	// If there is a gap before POS, this duplicates the previous ack to provoke the peer into retransmitting.
+	s.send(&AckMessage{Session: s.Token, Length: s.received})
+}
+
+// receive stores the part of data at pos that has not already been received.
+func (s *Session) receive(pos uint32, data string) {
+	end := uint64(pos) + uint64(len(data))
+	if end <= uint64(s.received) || end >= MaximumNumericFieldValue {
+		return
+	}
+	fresh := data[s.received-pos:]
+	s.inbound.WriteString(fresh)
+	s.received += uint32(len(fresh))
+
+	select {
+	case s.readable <- struct{}{}:
+	default:
+	}
+}
+
+// receivePending stores pending data that is no longer separated by a gap.
+func (s *Session) receivePending() {
+	for progress := true; progress; {
+		progress = false
+		for pos, data := range s.pending {
+			if pos <= s.received {
+				delete(s.pending, pos)
+				s.receive(pos, data)
+				progress = true
+			}
+		}
+	}
+}
+
+func (s *Session) handleAck(m *AckMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// If the LENGTH value is not larger than the largest LENGTH value in any ack message you've received on this
+	// session so far, do nothing (it's a duplicate ack).
+	if m.Length <= s.acked {
+		return
+	}
+	// If the LENGTH value is larger than the total amount of payload you've sent: the peer is misbehaving, close the session.
+	if m.Length > s.sent {
+		slog.Debug("peer acknowledged unsent data", "session", s.Token, "length", m.Length, "sent", s.sent)
+		s.send(&CloseMessage{Session: s.Token})
+		s.teardown()
+		return
+	}
+
+	s.unacked = s.unacked[m.Length-s.acked:]
+	s.acked = m.Length
+	s.waitingSince = time.Now()
+
+	if s.acked == s.sent {
+		s.stopRetransmission()
+		return
+	}
+	// If the LENGTH value is smaller than the total amount of payload you've sent: retransmit all payload data after
+	// the first LENGTH bytes.
+	s.retransmissions += uint64(s.transmit(s.acked, s.unacked))
+}
+
+// scheduleRetransmission starts retransmitting unacknowledged payload data, unless it is already being retransmitted.
+func (s *Session) scheduleRetransmission() {
+	if s.retransmission != nil {
+		return
+	}
+	s.waitingSince = time.Now()
+	s.retransmission = time.AfterFunc(s.config.RetransmissionTimeout, s.retransmit)
+}
+
+func (s *Session) stopRetransmission() {
+	if s.retransmission != nil {
+		s.retransmission.Stop()
+		s.retransmission = nil
+	}
+}
+
+// retransmit retransmits unacknowledged payload data, or expires the session if the peer has stopped responding.
+func (s *Session) retransmit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() || s.retransmission == nil || s.acked == s.sent {
+		return
+	}
+	// If the session expiry timeout elapses without any acks, accept that the peer has disappeared.
+	if time.Since(s.waitingSince) >= s.config.SessionExpiryTimeout {
+		slog.Debug("session expired", "session", s.Token, "acked", s.acked, "sent", s.sent)
+		s.teardown()
+		return
+	}
+
+	s.retransmissions += uint64(s.transmit(s.acked, s.unacked))
+	s.retransmission.Reset(s.config.RetransmissionTimeout)
+}
+
+// touch records that a message was received from the peer.
+func (s *Session) touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastReceived = time.Now()
+}
+
+// watchSilence expires the session once nothing has been received from the peer for the session expiry timeout.
+//
+// Retransmission only expires a session while it has unacknowledged data, so without this a peer that opens a session
+// and goes silent before completing a line would hold it open forever.
+func (s *Session) watchSilence() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return
+	}
+	s.silence = time.AfterFunc(s.config.SessionExpiryTimeout, s.expireIfSilent)
+}
+
+func (s *Session) expireIfSilent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed() {
+		return
+	}
+	silent := time.Since(s.lastReceived)
+	if silent >= s.config.SessionExpiryTimeout {
+		slog.Debug("session expired after silence", "session", s.Token, "silent", silent)
+		s.teardown()
+		return
+	}
+	s.silence.Reset(s.config.SessionExpiryTimeout - silent)
+}
+
+func (s *Session) handleClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Send a matching close message and close the session.
+	s.send(&CloseMessage{Session: s.Token})
+	s.teardown()
+}
+
+// transmit sends data at pos in as many data messages as needed to stay within the maximum message size, and returns
+// the number of messages sent.
+func (s *Session) transmit(pos uint32, data []byte) int {
+	messages := SplitData(s.Token, pos, data)
+	for _, m := range messages {
+		s.send(m)
+	}
+	return len(messages)
+}
+
+// send writes a message to the peer.
+//
+// Delivery of individual messages is not guaranteed, so write errors are logged rather than returned.
+func (s *Session) send(m Message) {
+	if err := writeMessage(s.conn, s.addr, m); err != nil {
+		slog.Warn("error writing message", "session", s.Token, "err", err)
+	}
+}
+
+func (s *Session) isClosed() bool {
+	return isClosed(s.closed)
+}
+
+// teardown releases the session without notifying the peer.
+func (s *Session) teardown() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.stopRetransmission()
+		if s.silence != nil {
+			s.silence.Stop()
+		}
+		if s.onClose != nil {
+			s.onClose(s)
+		}
+	})
+}
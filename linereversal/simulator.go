@@ -0,0 +1,185 @@
+package linereversal
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// NetworkConditions describes how a simulated network mistreats the packets sent over it.
+//
+// The zero value describes a perfect network that delivers every packet immediately and in order.
+type NetworkConditions struct {
+	// Seed seeds the decisions about which packets are dropped, duplicated and delayed.
+	Seed uint64
+	// DropRate is the probability that a packet is lost.
+	DropRate float64
+	// DuplicateRate is the probability that a packet is delivered twice.
+	DuplicateRate float64
+	// ReorderWindow is the maximum additional random delay of each packet, so packets sent within the window of one
+	// another may arrive in any order.
+	ReorderWindow time.Duration
+	// Latency is the minimum delay of each packet.
+	Latency time.Duration
+}
+
+// SimulatedPacketConnPair returns two in-memory packet connections that send packets to one another over a network with
+// the given conditions, so LRCP can be exercised under packet loss, duplication and reordering.
+func SimulatedPacketConnPair(conditions NetworkConditions) (net.PacketConn, net.PacketConn) {
+	n := &simulatedNetwork{
+		conditions: conditions,
+		rand:       rand.New(rand.NewPCG(conditions.Seed, conditions.Seed)),
+	}
+	a, b := n.newConn("a"), n.newConn("b")
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+type simulatedNetwork struct {
+	mu         sync.Mutex
+	conditions NetworkConditions
+	rand       *rand.Rand
+}
+
+func (n *simulatedNetwork) newConn(name string) *simulatedConn {
+	return &simulatedConn{
+		network:      n,
+		addr:         simulatedAddr(name),
+		readable:     make(chan struct{}, 1),
+		readDeadline: newDeadline(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// delays returns the delay of each copy of a packet that is delivered.
+func (n *simulatedNetwork) delays() []time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.rand.Float64() < n.conditions.DropRate {
+		return nil
+	}
+	copies := 1
+	if n.rand.Float64() < n.conditions.DuplicateRate {
+		copies++
+	}
+
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = n.conditions.Latency
+		if n.conditions.ReorderWindow > 0 {
+			delays[i] += time.Duration(n.rand.Int64N(int64(n.conditions.ReorderWindow)))
+		}
+	}
+	return delays
+}
+
+type simulatedAddr string
+
+func (a simulatedAddr) Network() string { return "simulated" }
+func (a simulatedAddr) String() string  { return string(a) }
+
+type simulatedPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// A simulatedConn is one end of a simulated network.
+type simulatedConn struct {
+	network *simulatedNetwork
+	addr    simulatedAddr
+	peer    *simulatedConn
+
+	mu           sync.Mutex
+	queue        []simulatedPacket
+	readable     chan struct{}
+	readDeadline *deadline
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *simulatedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		if isClosed(c.closed) {
+			return 0, nil, net.ErrClosed
+		}
+		if isClosed(c.readDeadline.wait()) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			packet := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return copy(p, packet.data), packet.from, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.readable:
+		case <-c.readDeadline.wait():
+		case <-c.closed:
+		}
+	}
+}
+
+func (c *simulatedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if isClosed(c.closed) {
+		return 0, net.ErrClosed
+	}
+	if addr.String() != c.peer.addr.String() {
+		return 0, fmt.Errorf("simulated network: no route to %s", addr)
+	}
+
+	packet := simulatedPacket{data: append([]byte(nil), p...), from: c.addr}
+	for _, delay := range c.network.delays() {
+		if delay == 0 {
+			c.peer.deliver(packet)
+		} else {
+			time.AfterFunc(delay, func() { c.peer.deliver(packet) })
+		}
+	}
+	return len(p), nil
+}
+
+func (c *simulatedConn) deliver(packet simulatedPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if isClosed(c.closed) {
+		return
+	}
+	c.queue = append(c.queue, packet)
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *simulatedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *simulatedConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *simulatedConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simulatedConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, since writes to a simulated network never block.
+func (c *simulatedConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
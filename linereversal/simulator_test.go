@@ -0,0 +1,90 @@
+package linereversal
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulatedPacketConnPair(t *testing.T) {
+	a, b := SimulatedPacketConnPair(NetworkConditions{})
+
+	for _, m := range []string{"one", "two", "three"} {
+		_, err := a.WriteTo([]byte(m), b.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	// A perfect network delivers every packet in order.
+	buf := make([]byte, 16)
+	for _, expected := range []string{"one", "two", "three"} {
+		n, from, err := b.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(buf[:n]))
+		assert.Equal(t, a.LocalAddr(), from)
+	}
+}
+
+func TestSimulatedPacketConnPair_Drop(t *testing.T) {
+	a, b := SimulatedPacketConnPair(NetworkConditions{DropRate: 1})
+
+	_, err := a.WriteTo([]byte("lost"), b.LocalAddr())
+	require.NoError(t, err)
+
+	require.NoError(t, b.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, _, err = b.ReadFrom(make([]byte, 16))
+	assert.Error(t, err)
+}
+
+func TestSession_AdverseNetwork(t *testing.T) {
+	config := Config{
+		RetransmissionTimeout: 20 * time.Millisecond,
+		SessionExpiryTimeout:  5 * time.Second,
+	}
+
+	for name, conditions := range map[string]NetworkConditions{
+		"loss":        {Seed: 1, DropRate: 0.2},
+		"duplication": {Seed: 2, DuplicateRate: 0.5},
+		"reordering":  {Seed: 3, ReorderWindow: 10 * time.Millisecond, Latency: time.Millisecond},
+		"all":         {Seed: 4, DropRate: 0.1, DuplicateRate: 0.1, ReorderWindow: 5 * time.Millisecond, Latency: time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			serverConn, clientConn := SimulatedPacketConnPair(conditions)
+			l := ListenWithConfig(serverConn, config)
+			defer l.Close()
+
+			// Echo everything received back to the client.
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = io.Copy(conn, conn)
+			}()
+
+			conn, err := DialPacket(clientConn, serverConn.LocalAddr(), config)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			message := bytes.Repeat([]byte("hello/world\\\n"), 1000)
+			go func() {
+				// Write in pieces so data is interleaved with acks.
+				for chunk := range slices.Chunk(message, 700) {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+			echoed := make([]byte, len(message))
+			_, err = io.ReadFull(conn, echoed)
+			require.NoError(t, err)
+			assert.Equal(t, message, echoed)
+		})
+	}
+}
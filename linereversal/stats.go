@@ -0,0 +1,69 @@
+package linereversal
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"time"
+)
+
+// SessionStats is a snapshot of the state of a session.
+type SessionStats struct {
+	Session SessionToken `json:"session"`
+	Addr    string       `json:"addr"`
+	// BytesReceived is the amount of contiguous payload data received from the peer.
+	BytesReceived uint32 `json:"bytes_received"`
+	// BytesSent is the amount of payload data written by the application.
+	BytesSent uint32 `json:"bytes_sent"`
+	// BytesAcked is the amount of payload data acknowledged by the peer.
+	BytesAcked uint32 `json:"bytes_acked"`
+	// Retransmissions is the number of data messages sent again because they were not acknowledged.
+	Retransmissions uint64        `json:"retransmissions"`
+	Age             time.Duration `json:"age_ns"`
+}
+
+// ListenerStats is a snapshot of the sessions of an LRCPListener.
+type ListenerStats struct {
+	OpenSessions int `json:"open_sessions"`
+	// MessagesReceived counts the legal messages received by the listener, by type.
+	MessagesReceived map[MessageType]uint64 `json:"messages_received"`
+	// Sessions are ordered by session token.
+	Sessions []SessionStats `json:"sessions"`
+}
+
+// Stats returns a snapshot of the sessions of the listener.
+func (l *LRCPListener) Stats() ListenerStats {
+	l.mu.Lock()
+	sessions := make([]*Session, 0, len(l.Sessions))
+	for _, s := range l.Sessions {
+		sessions = append(sessions, s)
+	}
+	stats := ListenerStats{
+		OpenSessions:     len(sessions),
+		MessagesReceived: maps.Clone(l.messagesReceived),
+	}
+	l.mu.Unlock()
+
+	// Sessions lock themselves, and may lock the listener when they close, so they are read without holding l.mu.
+	for _, s := range sessions {
+		stats.Sessions = append(stats.Sessions, s.Stats())
+	}
+	slices.SortFunc(stats.Sessions, func(a, b SessionStats) int { return cmp.Compare(a.Session, b.Session) })
+	return stats
+}
+
+// Stats returns a snapshot of the state of the session.
+func (s *Session) Stats() SessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionStats{
+		Session:         s.Token,
+		Addr:            s.addr.String(),
+		BytesReceived:   s.received,
+		BytesSent:       s.sent,
+		BytesAcked:      s.acked,
+		Retransmissions: s.retransmissions,
+		Age:             time.Since(s.opened),
+	}
+}
@@ -2,31 +2,53 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/benjaminclauss/protohackers/linereversal"
 	"github.com/benjaminclauss/protohackers/speeddaemon"
+	"io"
 	"log"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
+// shutdownTimeout bounds how long the servers have to shut down after SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+const (
+	// recordShards is the number of speed daemon enforcement workers.
+	recordShards = 8
+	// recordShardCapacity is the number of records each enforcement worker can fall behind by before records are dropped.
+	recordShardCapacity = 1024
+	// recordSubmitTimeout bounds how long a full shard stalls a camera for each record. It absorbs short bursts without
+	// letting a slow enforcement worker hold up cameras for long.
+	recordSubmitTimeout = 100 * time.Millisecond
+)
+
 func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug, // now debug messages are shown too
 	}))
 	slog.SetDefault(logger)
 
-	g, _ := errgroup.WithContext(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	g, ctx := errgroup.WithContext(ctx)
 
-	g.Go(func() error { return serve(50001, Echo) })
-	g.Go(func() error { return serve(50002, PrimeTime) })
-	g.Go(func() error { return serve(50003, MeansToAnEnd) })
+	g.Go(func() error { return serve(ctx, 50001, Echo) })
+	g.Go(func() error { return serve(ctx, 50002, PrimeTime) })
+	g.Go(func() error { return serve(ctx, 50003, MeansToAnEnd) })
 
 	chat := NewBudgetChat(DefaultWelcomeMessage)
-	g.Go(func() error { return serve(50004, chat.Handle) })
+	g.Go(func() error { return serve(ctx, 50004, chat.Handle) })
 
 	host := os.Getenv("HOST")
 	if host == "" {
@@ -40,25 +62,100 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		return p.Listen(pc)
+		return listenPacket(ctx, pc, p.Listen)
 	})
 
-	g.Go(func() error { return serve(50006, MobInTheMiddle) })
+	g.Go(func() error { return serve(ctx, 50006, MobInTheMiddle) })
+
+	// TODO: Inject this in deploy.
+	lrcpConn, err := net.ListenPacket("udp", host+":50009")
+	if err != nil {
+		log.Fatal(err)
+	}
+	lineReversal := linereversal.ListenWithConfig(lrcpConn, linereversal.DefaultConfig)
+	g.Go(func() error { return serveListener(ctx, lineReversal, LineReversal) })
+
+	records := speeddaemon.NewRecordPipeline(recordShards, recordShardCapacity, recordSubmitTimeout)
 
 	g.Go(func() error {
 		http.HandleFunc("/", landingPageHandler)
-		return http.ListenAndServe(":8080", nil)
+		http.HandleFunc("/linereversal/sessions", lineReversalSessionsHandler(lineReversal))
+		http.HandleFunc("/speeddaemon/records", speedDaemonRecordsHandler(records))
+		srv := &http.Server{Addr: ":8080"}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Warn("error shutting down HTTP server", "err", err)
+			}
+		}()
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
 	})
 
-	records := make(chan speeddaemon.CameraRecord)
-	server := speeddaemon.SpeedLimitEnforcementServer{
-		CameraHandler:     speeddaemon.NewCameraHandler(records),
-		DispatcherHandler: speeddaemon.NewDispatcherHandler(),
+	var (
+		observations speeddaemon.ObservationStore = speeddaemon.NewMemoryObservationStore()
+		tickets      speeddaemon.TicketLedger     = speeddaemon.NewMemoryTicketLedger()
+		ticketQueue  speeddaemon.TicketQueue      = speeddaemon.NewMemoryTicketQueue()
+	)
+	// Speed daemon state is kept in DATA_DIR when it is set, so it survives a restart.
+	if dataDir := os.Getenv("DATA_DIR"); dataDir != "" {
+		if observations, err = speeddaemon.OpenFileObservationStore(filepath.Join(dataDir, "observations.jsonl")); err != nil {
+			log.Fatal(err)
+		}
+		fileTickets, err := speeddaemon.OpenFileTicketLedger(filepath.Join(dataDir, "tickets.jsonl"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileTicketQueue, err := speeddaemon.OpenFileTicketQueue(filepath.Join(dataDir, "ticket-queue.jsonl"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		// A crash between issuing a ticket and queueing it leaves the ticket only in the ledger.
+		if _, err := fileTicketQueue.Requeue(fileTickets.Recovered()); err != nil {
+			log.Fatal(err)
+		}
+		tickets, ticketQueue = fileTickets, fileTicketQueue
+	}
+
+	// DISPATCH_POLICY chooses how tickets are spread across the dispatchers for a road.
+	dispatchPolicy := os.Getenv("DISPATCH_POLICY")
+	if dispatchPolicy == "" {
+		dispatchPolicy = "round-robin"
+	}
+	policy, err := speeddaemon.ParseDispatchPolicy(dispatchPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &speeddaemon.SpeedLimitEnforcementServer{
+		CameraHandler:     speeddaemon.NewCameraHandler(observations, records),
+		DispatcherHandler: speeddaemon.NewDispatcherHandler(ticketQueue, policy),
 		Records:           records,
-		TicketsSent:       make(map[speeddaemon.TicketOnDay]bool),
+		Tickets:           tickets,
+	}
+	speedDaemonListener, err := net.Listen("tcp", ":50007")
+	if err != nil {
+		log.Fatal(err)
 	}
-	g.Go(func() error { return serve(50007, server.Handle) })
-	g.Go(server.EnforceSpeedLimit)
+	g.Go(func() error {
+		if err := server.Serve(speedDaemonListener); !errors.Is(err, speeddaemon.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	// The checker keeps running during shutdown to ticket the records already received, so it is only stopped by
+	// Shutdown.
+	g.Go(func() error { return server.EnforceSpeedLimit(context.Background()) })
+	g.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	})
 
 	g.Go(func() error {
 		// TODO: Inject this in deploy.
@@ -66,28 +163,51 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		return p.Listen(pc)
+		return listenPacket(ctx, pc, p.Listen)
 	})
 
-	err := g.Wait()
+	err = g.Wait()
+	// Stores are closed once the speed daemon has stopped writing to them.
+	for _, store := range []any{observations, tickets, ticketQueue} {
+		if c, ok := store.(io.Closer); ok {
+			if closeErr := c.Close(); closeErr != nil {
+				slog.Error("error closing store", "err", closeErr)
+			}
+		}
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.Info("shut down")
 }
 
-func serve(port int, handler func(net.Conn) error) error {
+func serve(ctx context.Context, port int, handler func(net.Conn) error) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
 	}
+	return serveListener(ctx, listener, handler)
+}
+
+// serveListener handles each connection accepted by listener in a new goroutine, until ctx is done.
+func serveListener(ctx context.Context, listener net.Listener, handler func(net.Conn) error) error {
 	defer listener.Close()
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
 
-	addr := listener.Addr().(*net.TCPAddr)
-	slog.Info("listening", "port", addr.Port)
+	slog.Info("listening", "addr", listener.Addr())
 
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
+		if ctx.Err() != nil {
+			// A connection accepted as ctx was done is not handled, so it is closed rather than leaked.
+			if err == nil {
+				_ = conn.Close()
+			}
+			return nil
+		} else if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if err != nil {
 			slog.Warn("connection error", "err", err)
 			continue
 		}
@@ -100,3 +220,15 @@ func serve(port int, handler func(net.Conn) error) error {
 		}()
 	}
 }
+
+// listenPacket calls listen with conn, closing conn to stop it when ctx is done.
+func listenPacket(ctx context.Context, conn net.PacketConn, listen func(net.PacketConn) error) error {
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	err := listen(conn)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -1,25 +1,24 @@
 package speeddaemon
 
 import (
-	"encoding/binary"
 	"fmt"
 	"log/slog"
-	"sync"
 )
 
-type CameraHandler struct {
-	mu sync.Mutex
+var ConflictingLimitError = &ErrorMessage{Msg: "speed limit conflicts with other cameras on road"}
 
-	// TODO: Move this to a separate struct. Dependency inversion principle.
-	recordings map[Car][]CameraRecord
+type CameraHandler struct {
+	observations ObservationStore
+	roads        *RoadRegistry
 
-	recordsChan chan<- CameraRecord
+	records *RecordPipeline
 }
 
-func NewCameraHandler(recordsChan chan<- CameraRecord) *CameraHandler {
+func NewCameraHandler(observations ObservationStore, records *RecordPipeline) *CameraHandler {
 	return &CameraHandler{
-		recordings:  make(map[Car][]CameraRecord),
-		recordsChan: recordsChan,
+		observations: observations,
+		roads:        NewRoadRegistry(),
+		records:      records,
 	}
 }
 
@@ -30,15 +29,18 @@ func (h *CameraHandler) handleCamera(conn *Conn) error {
 		slog.Error("bad connection", "ID", conn.ID, "error", err, "addr", conn.RemoteAddr())
 		return fmt.Errorf("error reading IAmCamera message: %w", err)
 	}
-
 	camera := Camera{Road: m.Road, Mile: m.Mile, Limit: m.Limit}
+	if err := h.roads.Register(camera); err != nil {
+		slog.Warn("rejecting camera", "id", conn.ID, "err", err)
+		return sendError(conn, ConflictingLimitError)
+	}
 	slog.Info("camera connected", "id", conn.ID, "road", camera.Road, "mile", camera.Mile, "limit", camera.Limit)
 
 	for {
 		slog.Debug("reading from connection", "ID", conn.ID)
-		var t uint8
 		// TODO: Should we ever disconnect client?
-		if err := binary.Read(conn, binary.BigEndian, &t); err != nil {
+		t, err := conn.ReadByte()
+		if err != nil {
 			return fmt.Errorf("error reading message type: %w", err)
 		}
 
@@ -50,7 +52,7 @@ func (h *CameraHandler) handleCamera(conn *Conn) error {
 			}
 		case WantHeartbeatMessageType:
 			// It is an error for a client to send multiple WantHeartbeat messages on a single connection.
-			if conn.Heartbeat != nil {
+			if conn.wantedHeartbeat {
 				return sendError(conn, MultipleWantHeartbeatMessagesError)
 			}
 			if err := beginHeartbeat(conn); err != nil {
@@ -72,33 +74,39 @@ func (h *CameraHandler) recordPlateMessage(c Camera, client *Conn) error {
 	if err != nil {
 		return fmt.Errorf("error reading plate message: %w", err)
 	}
+	if err := message.Validate(); err != nil {
+		return rejectMessage(client, err)
+	}
 
 	slog.Info("received plate message", "ID", client.ID, "road", c.Road, "mile", c.Mile, "limit", c.Limit,
 		"plate", message.Plate, "timestamp", message.Timestamp)
 
-	// TODO: Add camera information to record.
 	r := CameraRecord{Camera: c, PlateMessage: *message}
-	h.recordPlate(r)
+	if err := h.observations.Record(r); err != nil {
+		return fmt.Errorf("error storing observation: %w", err)
+	}
 
-	h.recordsChan <- r
+	// A full pipeline only stalls the camera for the pipeline's submit timeout before the record is dropped.
+	h.records.Submit(r)
 	return nil
 }
 
-func (h *CameraHandler) recordPlate(r CameraRecord) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	records, ok := h.recordings[Car(r.Plate)]
-	if !ok {
-		records = make([]CameraRecord, 0)
-	}
+func (h *CameraHandler) FetchPlateRecords(plate string) []CameraRecord {
+	return h.observations.Observations(Car(plate))
+}
 
-	h.recordings[Car(r.Plate)] = append(records, r)
+// FetchAdjacentRecords returns the records of r's car on r's road immediately before and after r by timestamp.
+func (h *CameraHandler) FetchAdjacentRecords(r CameraRecord) []CameraRecord {
+	return h.observations.Adjacent(r)
 }
 
-func (h *CameraHandler) FetchPlateRecords(plate string) []CameraRecord {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// FetchPlateRecordsBetween returns the records of a car from timestamp from to timestamp to, along with the records
+// immediately before and after them on each road.
+func (h *CameraHandler) FetchPlateRecordsBetween(plate string, from, to uint32) []CameraRecord {
+	return h.observations.Between(Car(plate), from, to)
+}
 
-	return h.recordings[Car(plate)]
+// FetchRoad returns a road that a camera has connected on.
+func (h *CameraHandler) FetchRoad(number uint16) (Road, bool) {
+	return h.roads.Road(number)
 }
@@ -0,0 +1,162 @@
+package speeddaemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A client is a connection to a speed daemon server, shared by cameras and dispatchers.
+type client struct {
+	// mu serializes writes, so messages are not interleaved.
+	mu      sync.Mutex
+	conn    net.Conn
+	encoder *Encoder
+
+	// tickets is nil unless the client is a dispatcher.
+	tickets    chan TicketMessage
+	errors     chan ErrorMessage
+	heartbeats chan struct{}
+	// err is the error that stopped the read loop, set before done is closed.
+	err  error
+	done chan struct{}
+}
+
+func dial(addr string, identify Message) (*client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		conn:       conn,
+		encoder:    NewEncoder(conn),
+		errors:     make(chan ErrorMessage, 1),
+		heartbeats: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if _, ok := identify.(*IAmDispatcherMessage); ok {
+		c.tickets = make(chan TicketMessage, 16)
+	}
+	if err := c.send(identify); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *client) send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.encoder.Encode(m)
+}
+
+// readLoop delivers messages from the server until the connection is closed.
+func (c *client) readLoop() {
+	defer close(c.done)
+	defer close(c.heartbeats)
+	defer close(c.errors)
+	if c.tickets != nil {
+		defer close(c.tickets)
+	}
+
+	decoder := NewDecoder(c.conn)
+	for {
+		m, err := decoder.Decode()
+		if err != nil {
+			// The server closes the connection after an error, and a closed client stops reading.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.err = err
+			}
+			return
+		}
+
+		switch m := m.(type) {
+		case *TicketMessage:
+			if c.tickets == nil {
+				c.err = errors.New("unexpected ticket sent to camera")
+				_ = c.conn.Close()
+				return
+			}
+			c.tickets <- *m
+		case *ErrorMessage:
+			c.errors <- *m
+		case *HeartbeatMessage:
+			// Heartbeats that have not been received yet are coalesced, so they never hold up other messages.
+			select {
+			case c.heartbeats <- struct{}{}:
+			default:
+			}
+		default:
+			c.err = fmt.Errorf("unexpected message from server: %02X", m.Type())
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+// WantHeartbeat asks the server to send a heartbeat every interval deciseconds. An interval of 0 turns heartbeats off.
+func (c *client) WantHeartbeat(interval uint32) error {
+	return c.send(&WantHeartbeatMessage{Interval: interval})
+}
+
+// Heartbeats receives a value when the server sends a heartbeat. It is closed when the connection is closed.
+func (c *client) Heartbeats() <-chan struct{} {
+	return c.heartbeats
+}
+
+// Errors receives the error messages sent by the server. It is closed when the connection is closed.
+func (c *client) Errors() <-chan ErrorMessage {
+	return c.errors
+}
+
+// Err returns the error that ended the connection, once it has ended, or nil if the server or client closed it.
+func (c *client) Err() error {
+	<-c.done
+	return c.err
+}
+
+func (c *client) Close() error {
+	return c.conn.Close()
+}
+
+// A CameraClient reports the number plates seen by a camera to a speed daemon server.
+type CameraClient struct {
+	*client
+}
+
+// DialCamera connects to the server at addr as a camera on road at mile, where the speed limit is limit.
+func DialCamera(addr string, road, mile, limit uint16) (*CameraClient, error) {
+	c, err := dial(addr, &IAmCameraMessage{Road: road, Mile: mile, Limit: limit})
+	if err != nil {
+		return nil, fmt.Errorf("error dialing camera: %w", err)
+	}
+	return &CameraClient{client: c}, nil
+}
+
+// ReportPlate reports that the camera saw plate at timestamp.
+func (c *CameraClient) ReportPlate(plate string, timestamp uint32) error {
+	return c.send(&PlateMessage{Plate: plate, Timestamp: timestamp})
+}
+
+// A DispatcherClient receives tickets for some roads from a speed daemon server.
+type DispatcherClient struct {
+	*client
+}
+
+// DialDispatcher connects to the server at addr as the ticket dispatcher for roads.
+func DialDispatcher(addr string, roads ...uint16) (*DispatcherClient, error) {
+	c, err := dial(addr, &IAmDispatcherMessage{Roads: roads})
+	if err != nil {
+		return nil, fmt.Errorf("error dialing dispatcher: %w", err)
+	}
+	return &DispatcherClient{client: c}, nil
+}
+
+// Tickets receives the tickets sent by the server. It is closed when the connection is closed.
+func (c *DispatcherClient) Tickets() <-chan TicketMessage {
+	return c.tickets
+}
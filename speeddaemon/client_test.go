@@ -0,0 +1,102 @@
+package speeddaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialDispatcher_ReceivesTickets(t *testing.T) {
+	_, addr, _ := startServer(t)
+
+	dispatcher, err := DialDispatcher(addr, 66, 368)
+	require.NoError(t, err)
+	defer dispatcher.Close()
+
+	first, err := DialCamera(addr, 368, 1234, 40)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := DialCamera(addr, 368, 1235, 40)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, first.ReportPlate("RE05BKG", 1000000))
+	require.NoError(t, second.ReportPlate("RE05BKG", 1000060))
+
+	select {
+	case ticket := <-dispatcher.Tickets():
+		assert.Equal(t, TicketMessage{Plate: "RE05BKG", Road: 368, Mile1: 1234, Timestamp1: 1000000, Mile2: 1235, Timestamp2: 1000060, Speed: 6000}, ticket)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ticket")
+	}
+}
+
+func TestDialCamera_WantHeartbeat(t *testing.T) {
+	_, addr, _ := startServer(t)
+
+	camera, err := DialCamera(addr, 123, 8, 60)
+	require.NoError(t, err)
+	defer camera.Close()
+	require.NoError(t, camera.WantHeartbeat(1))
+
+	for range 2 {
+		select {
+		case <-camera.Heartbeats():
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for heartbeat")
+		}
+	}
+
+	// Asking twice is an error, after which the server disconnects.
+	require.NoError(t, camera.WantHeartbeat(1))
+	for range camera.Heartbeats() {
+	}
+	assert.Equal(t, *MultipleWantHeartbeatMessagesError, <-camera.Errors())
+}
+
+func TestDialCamera_InvalidPlate(t *testing.T) {
+	_, addr, _ := startServer(t)
+
+	camera, err := DialCamera(addr, 123, 8, 60)
+	require.NoError(t, err)
+	defer camera.Close()
+	require.NoError(t, camera.ReportPlate("un1x", 0))
+
+	select {
+	case m := <-camera.Errors():
+		assert.Contains(t, m.Msg, "not uppercase alphanumeric")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
+
+func TestDialCamera_ZeroLimit(t *testing.T) {
+	_, addr, observations := startServer(t)
+
+	// The protocol does not restrict the speed limit, so a camera on a road with a limit of 0 is served like any other.
+	camera, err := DialCamera(addr, 123, 8, 0)
+	require.NoError(t, err)
+	defer camera.Close()
+	require.NoError(t, camera.ReportPlate("UN1X", 0))
+
+	require.Eventually(t, func() bool {
+		return len(observations.Observations("UN1X")) == 1
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, camera.Errors())
+}
+
+func TestDialDispatcher_NoRoads(t *testing.T) {
+	_, addr, _ := startServer(t)
+
+	dispatcher, err := DialDispatcher(addr)
+	require.NoError(t, err)
+	defer dispatcher.Close()
+
+	select {
+	case m := <-dispatcher.Errors():
+		assert.Contains(t, m.Msg, "no roads")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
@@ -0,0 +1,83 @@
+package speeddaemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A Decoder reads messages from a stream.
+type Decoder struct {
+	r io.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next message, returning a pointer to one of the message types.
+//
+// An unknown message type is reported with an error wrapping ErrUnknownMessageType, after reading only the type byte.
+// At the end of the stream, Decode returns io.EOF.
+func (d *Decoder) Decode() (Message, error) {
+	var t [1]byte
+	if _, err := io.ReadFull(d.r, t[:]); err != nil {
+		return nil, err
+	}
+
+	var m Message
+	var err error
+	switch t[0] {
+	case ErrorMessageType:
+		m, err = readErrorMessage(d.r)
+	case PlateMessageType:
+		m, err = readPlateMessage(d.r)
+	case TicketMessageType:
+		m, err = readTicketMessage(d.r)
+	case WantHeartbeatMessageType:
+		m, err = readWantHeartbeatMessage(d.r)
+	case HeartbeatMessageType:
+		m, err = readHeartbeatMessage(d.r)
+	case IAmCameraMessageType:
+		m, err = readIAmCameraMessage(d.r)
+	case IAmDispatcherMessageType:
+		m, err = readIAmDispatcherMessage(d.r)
+	default:
+		return nil, fmt.Errorf("%w: %02X", ErrUnknownMessageType, t[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading message %02X: %w", t[0], noEOF(err))
+	}
+	return m, nil
+}
+
+// An Encoder writes messages to a stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes a message with a single write, so messages from concurrent encoders on a connection are not
+// interleaved if the writer serializes writes.
+func (e *Encoder) Encode(m Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+	if _, err := e.w.Write(data); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	return nil
+}
+
+// noEOF converts an io.EOF partway through a message into io.ErrUnexpectedEOF, as io.EOF is only returned at the end
+// of the stream.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %v", io.ErrUnexpectedEOF, err)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package speeddaemon
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoderDecoder(t *testing.T) {
+	messages := []Message{
+		&ErrorMessage{Msg: "bad"},
+		&PlateMessage{Plate: "UN1X", Timestamp: 1000},
+		&TicketMessage{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000},
+		&WantHeartbeatMessage{Interval: 10},
+		&HeartbeatMessage{},
+		&IAmCameraMessage{Road: 66, Mile: 100, Limit: 60},
+		&IAmDispatcherMessage{Roads: []uint16{66, 368, 5000}},
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	for _, m := range messages {
+		require.NoError(t, e.Encode(m))
+	}
+
+	d := NewDecoder(&buf)
+	for _, expected := range messages {
+		m, err := d.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, expected, m)
+	}
+	_, err := d.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecoder_Decode(t *testing.T) {
+	tests := []struct {
+		name     string
+		given    []byte
+		expected error
+	}{
+		{name: "unknown type", given: []byte{0x42, 0x00}, expected: ErrUnknownMessageType},
+		{name: "truncated", given: []byte{0x20, 0x04, 0x55, 0x4e}, expected: io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(test.given)).Decode()
+			assert.ErrorIs(t, err, test.expected)
+		})
+	}
+}
+
+func TestTicketMessage_UnmarshalBinary(t *testing.T) {
+	given := []byte{0x21, 0x04, 0x55, 0x4e, 0x31, 0x58, 0x00, 0x42, 0x00, 0x64, 0x00, 0x01, 0xe2, 0x40, 0x00, 0x6e, 0x00, 0x01, 0xe3, 0xa8, 0x27, 0x10}
+	var m TicketMessage
+	require.NoError(t, m.UnmarshalBinary(given))
+	assert.Equal(t, TicketMessage{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000}, m)
+
+	assert.ErrorIs(t, m.UnmarshalBinary([]byte{0x10, 0x03, 0x62, 0x61, 0x64}), ErrUnexpectedMessageType)
+	assert.Error(t, m.UnmarshalBinary(append(given, 0x00)))
+}
@@ -1,80 +1,118 @@
 package speeddaemon
 
 import (
+	"bufio"
 	"fmt"
 	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Heartbeat struct {
-	Ticker *time.Ticker
-	Done   chan bool
-}
-
 // A Conn represents a unique client connection to the server.
+//
+// Reads are buffered, so reading a message takes one system call rather than one for each field.
 type Conn struct {
 	// mu protects concurrent write access to the underlying net.Conn.
 	mu sync.Mutex
 
 	ID uint64
 	net.Conn
-	Heartbeat *Heartbeat
+
+	reader *bufio.Reader
+
+	// heartbeats sends the heartbeats the client asks for. A connection without one sends no heartbeats.
+	heartbeats *HeartbeatScheduler
+	// wantedHeartbeat is set once the client has sent a WantHeartbeat message, even with an interval of 0.
+	wantedHeartbeat bool
+
+	// closed is set when the connection starts closing, before its heartbeats are cancelled.
+	closed    atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newConn(id uint64, conn net.Conn) *Conn {
+	return &Conn{ID: id, Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Read reads from the buffered connection. Only one goroutine may read from a connection.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// ReadByte reads a single byte from the buffered connection.
+func (c *Conn) ReadByte() (byte, error) {
+	return c.reader.ReadByte()
 }
 
+// Close closes the connection. Closing a connection more than once has no further effect.
 func (c *Conn) Close() error {
-	slog.Debug("closing connection", "id", c.ID)
+	c.closeOnce.Do(func() {
+		slog.Debug("closing connection", "id", c.ID)
+		c.closed.Store(true)
+		if c.heartbeats != nil {
+			c.heartbeats.Cancel(c)
+		}
+		// mu is not held, so closing the connection interrupts a blocked write rather than waiting for it.
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// writeTimeout bounds how long a write may block before the client is considered dead.
+const writeTimeout = 5 * time.Second
+
+// writeMessage writes an encoded message to the client without interleaving it with other writes.
+func (c *Conn) writeMessage(b []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.Heartbeat != nil {
-		// A client may have registered a "zero" heartbeat interval, in which case we don't need to stop the ticker.
-		if c.Heartbeat.Ticker != nil {
-			c.Heartbeat.Ticker.Stop()
-			c.Heartbeat.Done <- true
-		}
+	return c.write(b, writeTimeout)
+}
+
+// tryWriteMessage writes an encoded message to the client unless another write is in progress, and reports whether it
+// was written.
+func (c *Conn) tryWriteMessage(b []byte, timeout time.Duration) (bool, error) {
+	if !c.mu.TryLock() {
+		return false, nil
+	}
+	defer c.mu.Unlock()
+
+	if err := c.write(b, timeout); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	return c.Conn.Close()
+func (c *Conn) write(b []byte, timeout time.Duration) error {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(b); err != nil {
+		return err
+	}
+	// A deadline left on the connection would fail the next write long after this one, if it did not set its own.
+	return c.Conn.SetWriteDeadline(time.Time{})
 }
 
 const Decisecond = 100 * time.Millisecond
 
+// beginHeartbeat reads a WantHeartbeat message and schedules the heartbeats it asks for.
 func beginHeartbeat(conn *Conn) error {
 	m, err := readWantHeartbeatMessage(conn)
 	if err != nil {
 		return fmt.Errorf("error reading WantHeartbeat message: %w", err)
 	}
 
-	done := make(chan bool)
-	if m.Interval == 0 {
-		conn.Heartbeat = &Heartbeat{Done: done}
+	conn.wantedHeartbeat = true
+	if conn.heartbeats == nil {
+		slog.Warn("no heartbeat scheduler, ignoring WantHeartbeat", "connection", conn.ID, "interval", m.Interval)
 		return nil
 	}
-
-	ticker := time.NewTicker(time.Duration(m.Interval) * Decisecond)
-	conn.Heartbeat = &Heartbeat{Ticker: ticker, Done: done}
-
-	go heartbeat(conn)
-	return nil
-}
-
-func heartbeat(conn *Conn) {
-	for {
-		select {
-		case <-conn.Heartbeat.Done:
-			slog.Info("heartbeat done", "connection", conn.ID)
-			return
-		case t := <-conn.Heartbeat.Ticker.C:
-			slog.Info("heartbeat", "time", t, "connection", conn.ID)
-			m := HeartbeatMessage{}
-			bytes, _ := m.MarshalBinary()
-			conn.mu.Lock()
-			if _, err := conn.Write(bytes); err != nil {
-				slog.Warn("error writing heartbeat", "err", err)
-			}
-			conn.mu.Unlock()
-		}
+	if m.Interval > 0 {
+		conn.heartbeats.Schedule(conn, time.Duration(m.Interval)*Decisecond)
 	}
+	return nil
 }
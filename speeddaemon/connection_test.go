@@ -0,0 +1,121 @@
+package speeddaemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConn_WriteMessageClearsDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newConn(1, server)
+	defer conn.Close()
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+
+	sent, err := conn.tryWriteMessage([]byte{HeartbeatMessageType}, time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, sent)
+
+	// A write that does not set its own deadline is not failed by the deadline of the last one.
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Conn.Write([]byte{HeartbeatMessageType})
+	assert.NoError(t, err)
+}
+
+// BenchmarkConn_ReadPlateMessage measures how many Plate messages a connection can read per second: from a raw
+// net.Conn decoding each field with binary.Read, as the server used to, and with the current decoding from a raw
+// net.Conn and from a buffered Conn.
+func BenchmarkConn_ReadPlateMessage(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		wrap func(net.Conn) io.Reader
+		read func(io.Reader) error
+	}{
+		{name: "unbuffered binary.Read", wrap: func(conn net.Conn) io.Reader { return conn }, read: readPlateMessageFields},
+		{name: "unbuffered", wrap: func(conn net.Conn) io.Reader { return conn }, read: readTypeAndPlateMessage},
+		{name: "buffered", wrap: func(conn net.Conn) io.Reader { return newConn(1, conn) }, read: readTypeAndPlateMessage},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			r := bm.wrap(plateStream(b))
+
+			b.ResetTimer()
+			for range b.N {
+				if err := bm.read(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+func readTypeAndPlateMessage(r io.Reader) error {
+	var t [1]byte
+	if _, err := io.ReadFull(r, t[:]); err != nil {
+		return err
+	}
+	_, err := readPlateMessage(r)
+	return err
+}
+
+// readPlateMessageFields reads a message type and Plate message the way the server did before reads were buffered,
+// with a read for each field.
+func readPlateMessageFields(r io.Reader) error {
+	var t uint8
+	if err := binary.Read(r, binary.BigEndian, &t); err != nil {
+		return err
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	plate := make([]byte, length[0])
+	if _, err := io.ReadFull(r, plate); err != nil {
+		return err
+	}
+	var timestamp uint32
+	return binary.Read(r, binary.BigEndian, &timestamp)
+}
+
+// plateStream returns a TCP connection from a camera that sends Plate messages until the benchmark ends.
+func plateStream(b *testing.B) net.Conn {
+	b.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = listener.Close() })
+
+	var batch bytes.Buffer
+	m := &PlateMessage{Plate: "UN1X", Timestamp: 1000}
+	for range 1024 {
+		data, err := m.MarshalBinary()
+		require.NoError(b, err)
+		batch.Write(data)
+	}
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, err := conn.Write(batch.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(b, err)
+	b.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
@@ -0,0 +1,102 @@
+package speeddaemon
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+// A DispatchPolicy chooses which of the dispatchers for a road receives a ticket.
+type DispatchPolicy interface {
+	// Choose returns the dispatcher for road that receives the next ticket. dispatchers is never empty.
+	Choose(road uint16, dispatchers []*Conn) *Conn
+	// Forget discards anything the policy knows about a dispatcher that has disconnected.
+	Forget(dispatcher *Conn)
+}
+
+// ParseDispatchPolicy returns the policy with the given name: "round-robin", "least-recently-used" or "random".
+func ParseDispatchPolicy(name string) (DispatchPolicy, error) {
+	switch name {
+	case "round-robin":
+		return NewRoundRobinPolicy(), nil
+	case "least-recently-used":
+		return NewLeastRecentlyUsedPolicy(), nil
+	case "random":
+		return NewRandomPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown dispatch policy: %q", name)
+	}
+}
+
+// RoundRobinPolicy takes turns between the dispatchers for each road.
+type RoundRobinPolicy struct {
+	mu sync.Mutex
+
+	next map[uint16]int
+}
+
+func NewRoundRobinPolicy() *RoundRobinPolicy {
+	return &RoundRobinPolicy{next: make(map[uint16]int)}
+}
+
+func (p *RoundRobinPolicy) Choose(road uint16, dispatchers []*Conn) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Dispatchers may have disconnected since the last ticket, so the turn wraps around the current dispatchers.
+	i := p.next[road] % len(dispatchers)
+	p.next[road] = i + 1
+	return dispatchers[i]
+}
+
+func (p *RoundRobinPolicy) Forget(*Conn) {}
+
+// LeastRecentlyUsedPolicy chooses the dispatcher for a road that has gone longest without a ticket.
+//
+// Dispatchers that have never received a ticket are chosen first.
+type LeastRecentlyUsedPolicy struct {
+	mu sync.Mutex
+
+	// lastUsed orders dispatchers by when they were last chosen.
+	lastUsed map[uint64]uint64
+	clock    uint64
+}
+
+func NewLeastRecentlyUsedPolicy() *LeastRecentlyUsedPolicy {
+	return &LeastRecentlyUsedPolicy{lastUsed: make(map[uint64]uint64)}
+}
+
+func (p *LeastRecentlyUsedPolicy) Choose(_ uint16, dispatchers []*Conn) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	chosen := dispatchers[0]
+	for _, d := range dispatchers[1:] {
+		if p.lastUsed[d.ID] < p.lastUsed[chosen.ID] {
+			chosen = d
+		}
+	}
+	p.clock++
+	p.lastUsed[chosen.ID] = p.clock
+	return chosen
+}
+
+func (p *LeastRecentlyUsedPolicy) Forget(dispatcher *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.lastUsed, dispatcher.ID)
+}
+
+// RandomPolicy chooses a dispatcher for a road uniformly at random.
+type RandomPolicy struct{}
+
+func NewRandomPolicy() *RandomPolicy {
+	return &RandomPolicy{}
+}
+
+func (p *RandomPolicy) Choose(_ uint16, dispatchers []*Conn) *Conn {
+	return dispatchers[rand.IntN(len(dispatchers))]
+}
+
+func (p *RandomPolicy) Forget(*Conn) {}
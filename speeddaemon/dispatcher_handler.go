@@ -1,7 +1,6 @@
 package speeddaemon
 
 import (
-	"encoding/binary"
 	"fmt"
 	"log/slog"
 	"slices"
@@ -13,14 +12,21 @@ type DispatcherHandler struct {
 
 	connections       map[uint64]*Conn
 	roadToDispatchers map[uint16][]*Conn
-	ticketQueue       []TicketMessage
+	// ticketQueue holds every ticket until it has been written to a dispatcher.
+	ticketQueue TicketQueue
+	// policy chooses between the dispatchers for a road.
+	policy DispatchPolicy
+	// sending holds the queued tickets that are being written to a dispatcher, so they are not sent twice.
+	sending map[TicketMessage]bool
 }
 
-func NewDispatcherHandler() *DispatcherHandler {
+func NewDispatcherHandler(ticketQueue TicketQueue, policy DispatchPolicy) *DispatcherHandler {
 	return &DispatcherHandler{
 		connections:       make(map[uint64]*Conn),
 		roadToDispatchers: make(map[uint16][]*Conn),
-		ticketQueue:       make([]TicketMessage, 0),
+		ticketQueue:       ticketQueue,
+		policy:            policy,
+		sending:           make(map[TicketMessage]bool),
 	}
 }
 
@@ -28,23 +34,25 @@ func (h *DispatcherHandler) handleDispatcher(conn *Conn) error {
 	h.mu.Lock()
 	h.connections[conn.ID] = conn
 	h.mu.Unlock()
+	defer h.disconnect(conn)
 
 	m, err := readIAmDispatcherMessage(conn)
 	if err != nil {
 		return fmt.Errorf("error reading IAmDispatcher message: %w", err)
 	}
+	if err := m.Validate(); err != nil {
+		return rejectMessage(conn, err)
+	}
 
 	d := TicketDispatcher{Roads: m.Roads}
-	// TODO: This is messy!
-	defer h.disconnect(conn, d)
 	h.registerForRoad(d, conn)
-	h.sendQueuedTickets(d, conn)
+	h.sendQueuedTickets(d)
 	slog.Info("dispatcher connected", "ID", conn.ID, "roads", d.Roads)
 
 	for {
-		var t uint8
 		// TODO: Should we ever disconnect client?
-		if err := binary.Read(conn, binary.BigEndian, &t); err != nil {
+		t, err := conn.ReadByte()
+		if err != nil {
 			return fmt.Errorf("error reading message type: %w", err)
 		}
 
@@ -53,7 +61,7 @@ func (h *DispatcherHandler) handleDispatcher(conn *Conn) error {
 			return sendError(conn, illegalMessage(t))
 		case WantHeartbeatMessageType:
 			// It is an error for a client to send multiple WantHeartbeat messages on a single connection.
-			if conn.Heartbeat != nil {
+			if conn.wantedHeartbeat {
 				return sendError(conn, MultipleWantHeartbeatMessagesError)
 			}
 			if err := beginHeartbeat(conn); err != nil {
@@ -83,76 +91,129 @@ func (h *DispatcherHandler) registerForRoad(d TicketDispatcher, conn *Conn) {
 	}
 }
 
-func (h *DispatcherHandler) disconnect(conn *Conn, d TicketDispatcher) {
-	// TODO: Log error. Should we do this here?
-	//_ = conn.Close()
+func (h *DispatcherHandler) disconnect(conn *Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	delete(h.connections, conn.ID)
-	for _, r := range d.Roads {
-		dispatchers, ok := h.roadToDispatchers[r]
-		if !ok {
-			continue
-		}
-		for i, c := range dispatchers {
-			if c == conn {
-				dispatchers = append(dispatchers[:i], dispatchers[i+1:]...)
-				break
-			}
-		}
-	}
+	h.unregister(conn)
 }
 
-func (h *DispatcherHandler) SendTicket(t TicketMessage) {
+// isConnected reports whether conn is connected as a dispatcher.
+func (h *DispatcherHandler) isConnected(conn *Conn) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	_, ok := h.connections[conn.ID]
+	return ok
+}
+
+// SendTicket sends a ticket to a dispatcher for its road.
+//
+// The ticket is queued until it has been written to a dispatcher, so if no dispatcher for the road is connected, or
+// every write fails, it is sent when the next dispatcher for the road connects.
+func (h *DispatcherHandler) SendTicket(t TicketMessage) {
+	data, err := t.MarshalBinary()
+	if err != nil {
+		// A ticket that cannot be encoded can never be delivered.
+		slog.Error("error marshaling ticket", "plate", t.Plate, "err", err)
+		return
+	}
+
 	slog.Debug("sending ticket", "plate", t.Plate, "ticket", t)
 
-	dispatchers := h.roadToDispatchers[t.Road]
-	if len(dispatchers) == 0 {
-		h.ticketQueue = append(h.ticketQueue, t)
-		slog.Debug("no dispatchers for road, queueing ticket", "road", t.Road, "plate", t.Plate, "speed", t.Speed)
+	if err := h.ticketQueue.Enqueue(t); err != nil {
+		slog.Error("error queueing ticket", "plate", t.Plate, "err", err)
+	}
+	if !h.deliver(t, data) {
+		slog.Debug("ticket not written, leaving it queued", "road", t.Road, "plate", t.Plate, "speed", t.Speed)
+	}
+}
+
+// sendQueuedTickets sends the queued tickets for the roads of a newly connected dispatcher.
+func (h *DispatcherHandler) sendQueuedTickets(d TicketDispatcher) {
+	slog.Debug("checking queued tickets")
+
+	queued := h.ticketQueue.Queued(d.Roads)
+	if len(queued) == 0 {
 		return
 	}
-	dispatcher := dispatchers[0]
-	fmt.Println(dispatcher.ID)
+	slog.Debug("sending queued tickets", "count", len(queued))
+
+	for _, t := range queued {
+		data, err := t.MarshalBinary()
+		if err != nil {
+			slog.Error("error marshaling queued ticket", "plate", t.Plate, "err", err)
+			continue
+		}
+		h.deliver(t, data)
+	}
+}
 
-	// TODO: Handle error.
-	marshalBinary, _ := t.MarshalBinary()
+// deliver writes a queued ticket to a dispatcher for its road and reports whether it was written.
+//
+// The dispatcher is chosen under h.mu, but the ticket is written after it is released, so a dispatcher that is slow to
+// accept a ticket does not hold up the tickets for other dispatchers, or dispatchers connecting. Dispatchers that fail
+// to accept the write are considered dead: they are removed and the next dispatcher for the road is tried. A written
+// ticket is removed from the queue.
+func (h *DispatcherHandler) deliver(t TicketMessage, data []byte) bool {
+	for {
+		dispatcher := h.claim(t)
+		if dispatcher == nil {
+			return false
+		}
 
-	dispatcher.mu.Lock()
-	defer dispatcher.mu.Unlock()
-	dispatcher.Conn.Write(marshalBinary)
+		if err := dispatcher.writeMessage(data); err != nil {
+			slog.Warn("error writing ticket, removing dispatcher", "ID", dispatcher.ID, "plate", t.Plate, "err", err)
+			h.unclaim(t, dispatcher)
+			// Closing the connection stops the dispatcher's handler.
+			closeOrLog(dispatcher)
+			continue
+		}
+
+		// The ticket is removed from the queue before it is unclaimed, so it cannot be sent again in between.
+		if err := h.ticketQueue.Delivered(t); err != nil {
+			slog.Error("error removing delivered ticket from queue", "plate", t.Plate, "err", err)
+		}
+		h.unclaim(t, nil)
+		return true
+	}
 }
 
-func (h *DispatcherHandler) sendQueuedTickets(d TicketDispatcher, conn *Conn) {
+// claim chooses the dispatcher to write a queued ticket to, and marks the ticket as being sent. It returns nil if no
+// dispatcher for the road is connected, or if the ticket is already being sent.
+func (h *DispatcherHandler) claim(t TicketMessage) *Conn {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	slog.Debug("checking queued tickets")
-
-	var remainInQueue, toSend []TicketMessage
-	for _, t := range h.ticketQueue {
-		if slices.Contains(d.Roads, t.Road) {
-			toSend = append(toSend, t)
-		} else {
-			remainInQueue = append(remainInQueue, t)
-		}
+	if h.sending[t] || len(h.roadToDispatchers[t.Road]) == 0 {
+		return nil
 	}
-	h.ticketQueue = remainInQueue
+	h.sending[t] = true
+	return h.policy.Choose(t.Road, h.roadToDispatchers[t.Road])
+}
 
-	if len(toSend) == 0 {
-		return
+// unclaim marks a ticket as no longer being sent, and removes dead, a dispatcher that failed to accept it, if not nil.
+func (h *DispatcherHandler) unclaim(t TicketMessage, dead *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sending, t)
+	if dead != nil {
+		h.unregister(dead)
 	}
-	slog.Debug("sending queued tickets", "count", len(toSend))
-
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
-	for _, m := range toSend {
-		marshalBinary, _ := m.MarshalBinary()
-		// TODO: Handle error above and below.
-		conn.Write(marshalBinary)
+}
+
+// unregister removes a dispatcher from every road.
+// h.mu must be held.
+func (h *DispatcherHandler) unregister(conn *Conn) {
+	delete(h.connections, conn.ID)
+	for r, dispatchers := range h.roadToDispatchers {
+		dispatchers = slices.DeleteFunc(dispatchers, func(c *Conn) bool { return c == conn })
+		if len(dispatchers) == 0 {
+			delete(h.roadToDispatchers, r)
+		} else {
+			h.roadToDispatchers[r] = dispatchers
+		}
 	}
+	h.policy.Forget(conn)
 }
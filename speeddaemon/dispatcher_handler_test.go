@@ -0,0 +1,245 @@
+package speeddaemon
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeDispatcher registers a dispatcher for roads and returns the client side of its connection.
+func pipeDispatcher(h *DispatcherHandler, id uint64, roads ...uint16) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	conn := newConn(id, server)
+	h.registerForRoad(TicketDispatcher{Roads: roads}, conn)
+	return conn, client
+}
+
+// readTicket reads an encoded ticket from a dispatcher's client connection.
+func readTicket(t *testing.T, client net.Conn, expected TicketMessage) {
+	t.Helper()
+
+	data, err := expected.MarshalBinary()
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, data, buf)
+}
+
+func TestDispatcherHandler_SendTicketReroutesFromDeadDispatcher(t *testing.T) {
+	h := NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy())
+	_, deadClient := pipeDispatcher(h, 1, 66)
+	_, liveClient := pipeDispatcher(h, 2, 66)
+	defer liveClient.Close()
+
+	// The first dispatcher's socket dies.
+	require.NoError(t, deadClient.Close())
+
+	ticket := TicketMessage{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readTicket(t, liveClient, ticket)
+	}()
+	h.SendTicket(ticket)
+	<-done
+
+	assert.Len(t, h.roadToDispatchers[66], 1)
+	assert.Empty(t, h.ticketQueue.Queued([]uint16{66}))
+}
+
+func TestDispatcherHandler_SendTicketQueuesUntilDispatcherConnects(t *testing.T) {
+	h := NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy())
+
+	ticket := TicketMessage{Plate: "RE05BKG", Road: 368, Mile1: 1234, Timestamp1: 1000000, Mile2: 1235, Timestamp2: 1000060, Speed: 6000}
+	h.SendTicket(ticket)
+	assert.Equal(t, []TicketMessage{ticket}, h.ticketQueue.Queued([]uint16{368}))
+
+	_, client := pipeDispatcher(h, 1, 368)
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readTicket(t, client, ticket)
+	}()
+	h.sendQueuedTickets(TicketDispatcher{Roads: []uint16{368}})
+	<-done
+
+	assert.Empty(t, h.ticketQueue.Queued([]uint16{368}))
+}
+
+func TestDispatcherHandler_SendTicketStalledDispatcher(t *testing.T) {
+	queue := NewMemoryTicketQueue()
+	h := NewDispatcherHandler(queue, NewRoundRobinPolicy())
+	_, stalledClient := pipeDispatcher(h, 1, 66)
+
+	// The dispatcher for road 66 never reads, so its ticket is written until the write times out.
+	stalled := TicketMessage{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000}
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		h.SendTicket(stalled)
+	}()
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.sending[stalled]
+	}, time.Second, time.Millisecond)
+
+	// Meanwhile, a dispatcher for another road connects and receives its ticket.
+	_, client := pipeDispatcher(h, 2, 368)
+	defer client.Close()
+	ticket := TicketMessage{Plate: "RE05BKG", Road: 368, Mile1: 1234, Timestamp1: 1000000, Mile2: 1235, Timestamp2: 1000060, Speed: 6000}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readTicket(t, client, ticket)
+	}()
+	h.SendTicket(ticket)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ticket held up by a stalled dispatcher on another road")
+	}
+
+	// The stalled ticket stays queued once its dispatcher dies.
+	require.NoError(t, stalledClient.Close())
+	<-sent
+	assert.Equal(t, []TicketMessage{stalled}, queue.Queued([]uint16{66, 368}))
+	assert.Empty(t, h.sending)
+}
+
+func TestFileTicketQueue_Recovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ticket-queue.jsonl")
+	delivered := TicketMessage{Plate: "UN1X", Road: 66, Timestamp1: 1, Timestamp2: 2, Speed: 10000}
+	pending := TicketMessage{Plate: "RE05BKG", Road: 66, Timestamp1: 3, Timestamp2: 4, Speed: 6000}
+
+	q, err := OpenFileTicketQueue(path)
+	require.NoError(t, err)
+	require.NoError(t, q.Enqueue(delivered))
+	require.NoError(t, q.Enqueue(pending))
+	require.NoError(t, q.Delivered(delivered))
+	require.NoError(t, q.Close())
+
+	// Only tickets that were never delivered are recovered.
+	q, err = OpenFileTicketQueue(path)
+	require.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, []TicketMessage{pending}, q.Queued([]uint16{66}))
+}
+
+func TestFileTicketQueue_Requeue(t *testing.T) {
+	dir := t.TempDir()
+	delivered := TicketMessage{Plate: "UN1X", Road: 66, Timestamp1: 1, Timestamp2: 2, Speed: 10000}
+	pending := TicketMessage{Plate: "RE05BKG", Road: 66, Timestamp1: 3, Timestamp2: 4, Speed: 6000}
+	unqueued := TicketMessage{Plate: "SN0W", Road: 66, Timestamp1: 5, Timestamp2: 6, Speed: 7000}
+
+	l, err := OpenFileTicketLedger(filepath.Join(dir, "tickets.jsonl"))
+	require.NoError(t, err)
+	q, err := OpenFileTicketQueue(filepath.Join(dir, "ticket-queue.jsonl"))
+	require.NoError(t, err)
+	for _, ticket := range []TicketMessage{delivered, pending, unqueued} {
+		issued, err := l.Issue(ticket)
+		require.NoError(t, err)
+		require.True(t, issued)
+	}
+	require.NoError(t, q.Enqueue(delivered))
+	require.NoError(t, q.Enqueue(pending))
+	require.NoError(t, q.Delivered(delivered))
+	// The server crashes after issuing the last ticket but before queueing it.
+	require.NoError(t, l.Close())
+	require.NoError(t, q.Close())
+
+	l, err = OpenFileTicketLedger(filepath.Join(dir, "tickets.jsonl"))
+	require.NoError(t, err)
+	defer l.Close()
+	q, err = OpenFileTicketQueue(filepath.Join(dir, "ticket-queue.jsonl"))
+	require.NoError(t, err)
+	defer q.Close()
+	requeued, err := q.Requeue(l.Recovered())
+	require.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+	assert.Equal(t, []TicketMessage{pending, unqueued}, q.Queued([]uint16{66}))
+}
+
+func TestDispatcherHandler_DisconnectDeregisters(t *testing.T) {
+	h := NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy())
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newConn(1, server)
+
+	done := make(chan error)
+	go func() { done <- h.handleDispatcher(conn) }()
+
+	// The server has already read the IAmDispatcher message type; the body is for roads 66 and 368.
+	_, err := client.Write([]byte{2, 0, 66, 1, 112})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return len(h.roadToDispatchers[66]) == 1 && len(h.roadToDispatchers[368]) == 1
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, client.Close())
+	require.Error(t, <-done)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	assert.Empty(t, h.connections)
+	assert.Empty(t, h.roadToDispatchers)
+}
+
+func TestDispatcherHandler_SendTicketBalancesAcrossDispatchers(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-recently-used"} {
+		t.Run(name, func(t *testing.T) {
+			policy, err := ParseDispatchPolicy(name)
+			require.NoError(t, err)
+			h := NewDispatcherHandler(NewMemoryTicketQueue(), policy)
+			_, first := pipeDispatcher(h, 1, 66)
+			defer first.Close()
+			_, second := pipeDispatcher(h, 2, 66)
+			defer second.Close()
+
+			// Each dispatcher receives every other ticket.
+			for i, client := range []net.Conn{first, second, first, second} {
+				ticket := TicketMessage{Plate: "UN1X", Road: 66, Timestamp1: uint32(i) * 86400, Timestamp2: uint32(i)*86400 + 1, Speed: 10000}
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					readTicket(t, client, ticket)
+				}()
+				h.SendTicket(ticket)
+				<-done
+			}
+		})
+	}
+}
+
+func TestParseDispatchPolicy_Unknown(t *testing.T) {
+	_, err := ParseDispatchPolicy("first")
+	assert.Error(t, err)
+}
+
+func TestDispatcherHandler_WantHeartbeatWithoutScheduler(t *testing.T) {
+	h := NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy())
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newConn(1, server)
+	done := make(chan error, 1)
+	go func() { done <- h.handleDispatcher(conn) }()
+
+	// The server reads the type of the IAmDispatcher message before handing the connection over.
+	identify, err := (&IAmDispatcherMessage{Roads: []uint16{66}}).MarshalBinary()
+	require.NoError(t, err)
+	_, err = client.Write(identify[1:])
+	require.NoError(t, err)
+	require.NoError(t, NewEncoder(client).Encode(&WantHeartbeatMessage{Interval: 1}))
+	// The connection has no scheduler, so the WantHeartbeat message is accepted without sending heartbeats.
+	require.NoError(t, client.Close())
+	assert.ErrorIs(t, <-done, io.EOF)
+}
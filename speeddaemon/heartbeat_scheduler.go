@@ -0,0 +1,235 @@
+package speeddaemon
+
+import (
+	"container/heap"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatWriteTimeout bounds how long the scheduler waits to write a heartbeat, as every other heartbeat waits
+	// too. A heartbeat that times out is not the end of the connection: the client is given writeTimeout to accept one,
+	// as it is for a ticket.
+	heartbeatWriteTimeout = 50 * time.Millisecond
+	// heartbeatRetryDelay is how soon a heartbeat is tried again when another message was being written to the
+	// connection.
+	heartbeatRetryDelay = 10 * time.Millisecond
+)
+
+// A HeartbeatScheduler sends heartbeats to the connections that want them.
+//
+// Connections are kept in a heap ordered by their next heartbeat, and a single goroutine sends the heartbeats that are
+// due, so thousands of connections cost one goroutine and one timer. The goroutine runs only while there are heartbeats
+// scheduled.
+type HeartbeatScheduler struct {
+	mu      sync.Mutex
+	queue   heartbeatQueue
+	entries map[*Conn]*heartbeatEntry
+	running bool
+	// stallTimeout is how long a connection may go without accepting a heartbeat before it is closed.
+	stallTimeout time.Duration
+	// wake interrupts the goroutine's wait when the earliest heartbeat changes.
+	wake chan struct{}
+}
+
+type heartbeatEntry struct {
+	conn     *Conn
+	interval time.Duration
+	next     time.Time
+	// index is the position of the entry in the heap.
+	index int
+	// stalledSince is when heartbeats to the connection started timing out, or zero if the last one was written. It is
+	// only used by the goroutine sending heartbeats.
+	stalledSince time.Time
+}
+
+func NewHeartbeatScheduler() *HeartbeatScheduler {
+	return &HeartbeatScheduler{
+		entries:      make(map[*Conn]*heartbeatEntry),
+		stallTimeout: writeTimeout,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Schedule sends a heartbeat to conn every interval, until Cancel is called or conn is closed. A connection that is
+// already closed is not scheduled.
+func (s *HeartbeatScheduler) Schedule(conn *Conn, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A connection is marked closed before it cancels its heartbeats, which waits for mu, so it is either refused here
+	// or cancelled once it closes.
+	if conn.closed.Load() {
+		return
+	}
+
+	if e, ok := s.entries[conn]; ok {
+		heap.Remove(&s.queue, e.index)
+	}
+	e := &heartbeatEntry{conn: conn, interval: interval, next: time.Now().Add(interval)}
+	s.entries[conn] = e
+	heap.Push(&s.queue, e)
+
+	if !s.running {
+		s.running = true
+		go s.run()
+	} else if e.index == 0 {
+		s.signal()
+	}
+}
+
+// Cancel stops the heartbeats to conn. Cancelling a connection without heartbeats has no effect.
+func (s *HeartbeatScheduler) Cancel(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[conn]
+	if !ok {
+		return
+	}
+	earliest := e.index == 0
+	delete(s.entries, conn)
+	heap.Remove(&s.queue, e.index)
+	if earliest {
+		s.signal()
+	}
+}
+
+// Len returns the number of connections with heartbeats scheduled.
+func (s *HeartbeatScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue)
+}
+
+func (s *HeartbeatScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *HeartbeatScheduler) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		due, wait, ok := s.due(time.Now())
+		if !ok {
+			return
+		}
+		for _, e := range due {
+			s.beat(e)
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// due returns the entries whose heartbeat is due at now and reschedules them, or how long to wait for the next
+// heartbeat if none are. It reports false, stopping the goroutine, once no heartbeats are scheduled.
+func (s *HeartbeatScheduler) due(now time.Time) ([]*heartbeatEntry, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.queue) == 0 {
+		s.running = false
+		return nil, 0, false
+	}
+	var due []*heartbeatEntry
+	for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+		e := s.queue[0]
+		due = append(due, e)
+		// A heartbeat delayed by more than its interval is not followed by a burst to catch up.
+		e.next = e.next.Add(e.interval)
+		if e.next.Before(now) {
+			e.next = now.Add(e.interval)
+		}
+		heap.Fix(&s.queue, 0)
+	}
+	return due, s.queue[0].next.Sub(now), true
+}
+
+// beat sends a heartbeat to the connection of e.
+//
+// If another message is being written to the connection, the heartbeat is tried again shortly rather than waiting for
+// the write. A connection that does not accept a heartbeat for stallTimeout, or that fails to write one, is closed, so
+// the client is not left waiting for heartbeats.
+func (s *HeartbeatScheduler) beat(e *heartbeatEntry) {
+	conn := e.conn
+	data, _ := (&HeartbeatMessage{}).MarshalBinary()
+	sent, err := conn.tryWriteMessage(data, heartbeatWriteTimeout)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if e.stalledSince.IsZero() {
+			e.stalledSince = time.Now()
+		}
+		if time.Since(e.stalledSince) < s.stallTimeout {
+			slog.Debug("connection not accepting heartbeats", "connection", conn.ID, "since", e.stalledSince)
+			return
+		}
+	}
+	if err != nil {
+		slog.Error("error writing heartbeat, closing connection", "connection", conn.ID, "err", err)
+		// The connection may already have been closed, in which case closing it again does not cancel its heartbeats.
+		s.Cancel(conn)
+		closeOrLog(conn)
+		return
+	}
+	if !sent {
+		slog.Debug("connection busy, retrying heartbeat", "connection", conn.ID)
+		s.retry(conn)
+		return
+	}
+	e.stalledSince = time.Time{}
+}
+
+// retry brings the next heartbeat to conn forward to heartbeatRetryDelay from now.
+func (s *HeartbeatScheduler) retry(conn *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[conn]
+	if !ok {
+		return
+	}
+	if next := time.Now().Add(heartbeatRetryDelay); next.Before(e.next) {
+		e.next = next
+		heap.Fix(&s.queue, e.index)
+	}
+}
+
+// A heartbeatQueue is a heap of heartbeats, ordered by when they are next due.
+type heartbeatQueue []*heartbeatEntry
+
+func (q heartbeatQueue) Len() int           { return len(q) }
+func (q heartbeatQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q heartbeatQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *heartbeatQueue) Push(x any) {
+	e := x.(*heartbeatEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *heartbeatQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
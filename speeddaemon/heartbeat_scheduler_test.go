@@ -0,0 +1,151 @@
+package speeddaemon
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeHeartbeats schedules heartbeats to a connection and returns the client side of it.
+func pipeHeartbeats(s *HeartbeatScheduler, id uint64, interval time.Duration) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	conn := newConn(id, server)
+	conn.heartbeats = s
+	s.Schedule(conn, interval)
+	return conn, client
+}
+
+func TestHeartbeatScheduler_ServesManyConnections(t *testing.T) {
+	s := NewHeartbeatScheduler()
+
+	const connections = 1000
+	var wg sync.WaitGroup
+	conns := make([]*Conn, connections)
+	for i := range conns {
+		conn, client := pipeHeartbeats(s, uint64(i), 10*time.Millisecond)
+		conns[i] = conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			buf := make([]byte, 3)
+			_, err := io.ReadFull(client, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte{HeartbeatMessageType, HeartbeatMessageType, HeartbeatMessageType}, buf)
+		}()
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	assert.Zero(t, s.Len())
+}
+
+func TestHeartbeatScheduler_CloseDuringHeartbeats(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	conn, client := pipeHeartbeats(s, 1, time.Millisecond)
+	go func() { _, _ = io.Copy(io.Discard, client) }()
+	time.Sleep(20 * time.Millisecond)
+
+	// Closing used to wait for the heartbeat goroutine while holding the lock it needed to send a heartbeat.
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out closing connection")
+	}
+	assert.Zero(t, s.Len())
+}
+
+func TestHeartbeatScheduler_ClosesUnwritableConnection(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	s.stallTimeout = 200 * time.Millisecond
+	conn, client := pipeHeartbeats(s, 1, time.Millisecond)
+	defer client.Close()
+
+	// The client does not read, so heartbeat writes time out, but the connection is only closed once it has not accepted
+	// one for the stall timeout.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, s.Len())
+	require.Eventually(t, func() bool { return s.Len() == 0 }, time.Second, 10*time.Millisecond)
+	_, err := conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	_, err = client.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHeartbeatScheduler_CancelsFailedConnection(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	conn, client := pipeHeartbeats(s, 1, time.Millisecond)
+	defer client.Close()
+
+	// The connection is closed as if it had been closed before its heartbeats were scheduled, so closing the Conn again
+	// cannot be what cancels them.
+	conn.closeOnce.Do(func() {})
+	require.NoError(t, conn.Conn.Close())
+	require.Eventually(t, func() bool { return s.Len() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestHeartbeatScheduler_ScheduleClosedConnection(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newConn(1, server)
+	conn.heartbeats = s
+
+	// The connection is closed while its handler is between reading WantHeartbeat and scheduling heartbeats.
+	require.NoError(t, conn.Close())
+	s.Schedule(conn, time.Millisecond)
+	assert.Zero(t, s.Len())
+}
+
+func TestHeartbeatScheduler_RetriesBusyConnection(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	// A ticket is being written when the first heartbeat is due.
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := newConn(1, server)
+	conn.heartbeats = s
+	conn.mu.Lock()
+	s.Schedule(conn, 200*time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	conn.mu.Unlock()
+
+	// The heartbeat follows the write rather than waiting for the next interval.
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{HeartbeatMessageType}, buf)
+	assert.Equal(t, 1, s.Len())
+	require.NoError(t, conn.Close())
+}
+
+func TestHeartbeatScheduler_Cancel(t *testing.T) {
+	s := NewHeartbeatScheduler()
+	conn, client := pipeHeartbeats(s, 1, time.Hour)
+	defer client.Close()
+	other, otherClient := pipeHeartbeats(s, 2, 10*time.Millisecond)
+	defer otherClient.Close()
+
+	// Cancelling the later heartbeat leaves the earlier one running.
+	s.Cancel(conn)
+	assert.Equal(t, 1, s.Len())
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(otherClient, buf)
+	require.NoError(t, err)
+
+	s.Cancel(other)
+	s.Cancel(other)
+	assert.Zero(t, s.Len())
+}
@@ -0,0 +1,97 @@
+package speeddaemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// A journal is an append-only file of JSON lines, used to make server state survive a restart.
+type journal struct {
+	mu sync.Mutex
+
+	file *os.File
+	// durable makes each append wait until the entry is on stable storage.
+	durable bool
+}
+
+// openJournal opens the journal at path, creating it if needed, and calls fn for each entry already in it.
+func openJournal[T any](path string, durable bool, fn func(T) error) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+
+	end, err := readJournal(file, fn)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	// Drop a truncated final entry so new entries are not appended to it.
+	if info, err := file.Stat(); err == nil && info.Size() > end {
+		if err := file.Truncate(end); err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("error truncating %s: %w", path, err)
+		}
+	}
+
+	return &journal{file: file, durable: durable}, nil
+}
+
+func (j *journal) append(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal error: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// Each entry is written with a single append, so a crash can only lose the last line.
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	if j.durable {
+		if err := j.file.Sync(); err != nil {
+			return fmt.Errorf("sync error: %w", err)
+		}
+	}
+	return nil
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// readJournal calls fn for each entry in r and returns the offset just past the last complete entry.
+//
+// A truncated final entry, left behind by a crash while it was being written, is skipped.
+func readJournal[T any](r io.Reader, fn func(T) error) (int64, error) {
+	decoder := json.NewDecoder(r)
+	var end int64
+	for {
+		var entry T
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return end, nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("skipping truncated journal entry", "offset", end)
+			return end, nil
+		} else if err != nil {
+			return end, err
+		}
+
+		if err := fn(entry); err != nil {
+			return end, err
+		}
+		// Entries are written one per line.
+		end = decoder.InputOffset() + 1
+	}
+}
@@ -1,7 +1,10 @@
 package speeddaemon
 
 import (
+	"bytes"
+	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -18,10 +21,26 @@ const (
 	IAmDispatcherMessageType       = 0x81
 )
 
+var (
+	ErrUnknownMessageType    = errors.New("unknown message type")
+	ErrUnexpectedMessageType = errors.New("unexpected message type")
+	// ErrInvalidMessage is returned by the Validate methods for a message whose fields break the protocol.
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// A Message is a message of the protocol, which is encoded as its type followed by its fields.
+type Message interface {
+	// Type returns the message type, the first byte of the encoded message.
+	Type() uint8
+	encoding.BinaryMarshaler
+}
+
 type ErrorMessage struct {
 	Msg string
 }
 
+func (m *ErrorMessage) Type() uint8 { return ErrorMessageType }
+
 func (m *ErrorMessage) MarshalBinary() ([]byte, error) {
 	data := []byte{ErrorMessageType}
 
@@ -34,28 +53,73 @@ func (m *ErrorMessage) MarshalBinary() ([]byte, error) {
 	return data, nil
 }
 
+func (m *ErrorMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readErrorMessage)
+}
+
+func readErrorMessage(r io.Reader) (*ErrorMessage, error) {
+	msg, err := readStr(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading msg: %w", err)
+	}
+	return &ErrorMessage{Msg: msg}, nil
+}
+
 type PlateMessage struct {
 	Plate     string
 	Timestamp uint32
 }
 
-func readPlateMessage(r io.Reader) (*PlateMessage, error) {
-	var lengthByte [1]byte
-	if _, err := io.ReadFull(r, lengthByte[:]); err != nil {
-		return nil, fmt.Errorf("error reading plate length: %w", err)
+func (m *PlateMessage) Type() uint8 { return PlateMessageType }
+
+func (m *PlateMessage) MarshalBinary() ([]byte, error) {
+	data := []byte{PlateMessageType}
+
+	plate, err := marshalStr(m.Plate)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling plate: %w", err)
+	}
+	data = append(data, plate...)
+
+	return binary.BigEndian.AppendUint32(data, m.Timestamp), nil
+}
+
+func (m *PlateMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readPlateMessage)
+}
+
+// Validate returns an error wrapping ErrInvalidMessage unless the plate is an uppercase alphanumeric string.
+func (m *PlateMessage) Validate() error {
+	if !validPlate(m.Plate) {
+		return fmt.Errorf("%w: plate %q is not uppercase alphanumeric", ErrInvalidMessage, m.Plate)
+	}
+	return nil
+}
+
+func validPlate(plate string) bool {
+	if plate == "" {
+		return false
+	}
+	for _, c := range []byte(plate) {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
 	}
+	return true
+}
 
-	plateBytes := make([]byte, lengthByte[0])
-	if _, err := io.ReadFull(r, plateBytes); err != nil {
+func readPlateMessage(r io.Reader) (*PlateMessage, error) {
+	plate, err := readStr(r)
+	if err != nil {
 		return nil, fmt.Errorf("error reading plate: %w", err)
 	}
 
-	var ts uint32
-	if err := binary.Read(r, binary.BigEndian, &ts); err != nil {
+	ts, err := readUint32(r)
+	if err != nil {
 		return nil, fmt.Errorf("error reading timestamp: %w", err)
 	}
 
-	return &PlateMessage{Plate: string(plateBytes), Timestamp: ts}, nil
+	return &PlateMessage{Plate: plate, Timestamp: ts}, nil
 }
 
 type TicketMessage struct {
@@ -75,6 +139,8 @@ type TicketMessage struct {
 	Speed uint16
 }
 
+func (m *TicketMessage) Type() uint8 { return TicketMessageType }
+
 func (m *TicketMessage) MarshalBinary() ([]byte, error) {
 	data := []byte{TicketMessageType}
 
@@ -109,6 +175,32 @@ func (m *TicketMessage) MarshalBinary() ([]byte, error) {
 	return data, nil
 }
 
+func (m *TicketMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readTicketMessage)
+}
+
+func readTicketMessage(r io.Reader) (*TicketMessage, error) {
+	plate, err := readStr(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plate: %w", err)
+	}
+
+	// The fields after the plate have a fixed size, so they are read at once.
+	var data [16]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return nil, fmt.Errorf("error reading fields: %w", err)
+	}
+	return &TicketMessage{
+		Plate:      plate,
+		Road:       binary.BigEndian.Uint16(data[0:]),
+		Mile1:      binary.BigEndian.Uint16(data[2:]),
+		Timestamp1: binary.BigEndian.Uint32(data[4:]),
+		Mile2:      binary.BigEndian.Uint16(data[8:]),
+		Timestamp2: binary.BigEndian.Uint32(data[10:]),
+		Speed:      binary.BigEndian.Uint16(data[14:]),
+	}, nil
+}
+
 func marshalStr(s string) ([]byte, error) {
 	if len(s) > 255 {
 		return nil, fmt.Errorf("string too long: %s", s)
@@ -122,15 +214,47 @@ func marshalStr(s string) ([]byte, error) {
 	return data, nil
 }
 
+func readUint32(r io.Reader) (uint32, error) {
+	var data [4]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(data[:]), nil
+}
+
+// readStr reads a str: a length byte followed by that many ASCII characters.
+func readStr(r io.Reader) (string, error) {
+	var lengthByte [1]byte
+	if _, err := io.ReadFull(r, lengthByte[:]); err != nil {
+		return "", fmt.Errorf("error reading length: %w", err)
+	}
+
+	data := make([]byte, lengthByte[0])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", fmt.Errorf("error reading characters: %w", err)
+	}
+	return string(data), nil
+}
+
 type WantHeartbeatMessage struct {
 	// Interval is the interval in deciseconds for which the server should send a heartbeat.
 	// An interval of 0 deciseconds means the client does not want to receive heartbeats (this is the default setting).
 	Interval uint32
 }
 
+func (m *WantHeartbeatMessage) Type() uint8 { return WantHeartbeatMessageType }
+
+func (m *WantHeartbeatMessage) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint32([]byte{WantHeartbeatMessageType}, m.Interval), nil
+}
+
+func (m *WantHeartbeatMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readWantHeartbeatMessage)
+}
+
 func readWantHeartbeatMessage(r io.Reader) (*WantHeartbeatMessage, error) {
-	var interval uint32
-	if err := binary.Read(r, binary.BigEndian, &interval); err != nil {
+	interval, err := readUint32(r)
+	if err != nil {
 		return nil, fmt.Errorf("error reading heartbeat interval: %w", err)
 	}
 	return &WantHeartbeatMessage{Interval: interval}, nil
@@ -138,10 +262,21 @@ func readWantHeartbeatMessage(r io.Reader) (*WantHeartbeatMessage, error) {
 
 type HeartbeatMessage struct{}
 
+func (m *HeartbeatMessage) Type() uint8 { return HeartbeatMessageType }
+
 func (m *HeartbeatMessage) MarshalBinary() ([]byte, error) {
 	return []byte{HeartbeatMessageType}, nil
 }
 
+func (m *HeartbeatMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readHeartbeatMessage)
+}
+
+// readHeartbeatMessage reads a Heartbeat message, which has no fields.
+func readHeartbeatMessage(io.Reader) (*HeartbeatMessage, error) {
+	return &HeartbeatMessage{}, nil
+}
+
 type IAmCameraMessage struct {
 	//The road field contains the road number that the camera is on.
 	Road uint16
@@ -151,18 +286,29 @@ type IAmCameraMessage struct {
 	Limit uint16
 }
 
+func (m *IAmCameraMessage) Type() uint8 { return IAmCameraMessageType }
+
+func (m *IAmCameraMessage) MarshalBinary() ([]byte, error) {
+	data := []byte{IAmCameraMessageType}
+	data = binary.BigEndian.AppendUint16(data, m.Road)
+	data = binary.BigEndian.AppendUint16(data, m.Mile)
+	return binary.BigEndian.AppendUint16(data, m.Limit), nil
+}
+
+func (m *IAmCameraMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readIAmCameraMessage)
+}
+
 func readIAmCameraMessage(r io.Reader) (*IAmCameraMessage, error) {
-	var road, mile, limit uint16
-	if err := binary.Read(r, binary.BigEndian, &road); err != nil {
-		return nil, fmt.Errorf("error reading road: %w", err)
-	}
-	if err := binary.Read(r, binary.BigEndian, &mile); err != nil {
-		return nil, fmt.Errorf("error reading mile: %w", err)
+	var data [6]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return nil, fmt.Errorf("error reading fields: %w", err)
 	}
-	if err := binary.Read(r, binary.BigEndian, &limit); err != nil {
-		return nil, fmt.Errorf("error reading limit: %w", err)
-	}
-	return &IAmCameraMessage{Road: road, Mile: mile, Limit: limit}, nil
+	return &IAmCameraMessage{
+		Road:  binary.BigEndian.Uint16(data[0:]),
+		Mile:  binary.BigEndian.Uint16(data[2:]),
+		Limit: binary.BigEndian.Uint16(data[4:]),
+	}, nil
 }
 
 type IAmDispatcherMessage struct {
@@ -170,6 +316,31 @@ type IAmDispatcherMessage struct {
 	Roads []uint16
 }
 
+func (m *IAmDispatcherMessage) Type() uint8 { return IAmDispatcherMessageType }
+
+func (m *IAmDispatcherMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Roads) > 255 {
+		return nil, fmt.Errorf("too many roads: %d", len(m.Roads))
+	}
+	data := []byte{IAmDispatcherMessageType, uint8(len(m.Roads))}
+	for _, road := range m.Roads {
+		data = binary.BigEndian.AppendUint16(data, road)
+	}
+	return data, nil
+}
+
+func (m *IAmDispatcherMessage) UnmarshalBinary(data []byte) error {
+	return unmarshalMessage(data, m, readIAmDispatcherMessage)
+}
+
+// Validate returns an error wrapping ErrInvalidMessage if the dispatcher is not responsible for any roads.
+func (m *IAmDispatcherMessage) Validate() error {
+	if len(m.Roads) == 0 {
+		return fmt.Errorf("%w: dispatcher has no roads", ErrInvalidMessage)
+	}
+	return nil
+}
+
 func readIAmDispatcherMessage(r io.Reader) (*IAmDispatcherMessage, error) {
 	var numRoadsByte [1]byte
 	if _, err := io.ReadFull(r, numRoadsByte[:]); err != nil {
@@ -177,13 +348,39 @@ func readIAmDispatcherMessage(r io.Reader) (*IAmDispatcherMessage, error) {
 	}
 
 	numRoads := numRoadsByte[0]
+	data := make([]byte, 2*int(numRoads))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("error reading roads: %w", err)
+	}
 	roads := make([]uint16, numRoads)
-
 	for i := range roads {
-		if err := binary.Read(r, binary.BigEndian, &roads[i]); err != nil {
-			return nil, fmt.Errorf("error reading road[%d]: %w", i, err)
-		}
+		roads[i] = binary.BigEndian.Uint16(data[2*i:])
 	}
 
 	return &IAmDispatcherMessage{Roads: roads}, nil
 }
+
+// unmarshalMessage decodes data, which must hold exactly one message of m's type, into m using read for its fields.
+func unmarshalMessage[T any, M interface {
+	*T
+	Message
+}](data []byte, m M, read func(io.Reader) (*T, error)) error {
+	r := bytes.NewReader(data)
+	t, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("error reading message type: %w", err)
+	}
+	if t != m.Type() {
+		return fmt.Errorf("%w: %02X, expected %02X", ErrUnexpectedMessageType, t, m.Type())
+	}
+
+	v, err := read(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%d bytes after message", r.Len())
+	}
+	*m = *v
+	return nil
+}
@@ -160,3 +160,27 @@ func Test_readIAmDispatcherMessage(t *testing.T) {
 		assert.Equal(t, test.expected, msg)
 	}
 }
+
+func TestMessage_Validate(t *testing.T) {
+	tests := []struct {
+		given interface{ Validate() error }
+		valid bool
+	}{
+		{given: &PlateMessage{Plate: "UN1X"}, valid: true},
+		{given: &PlateMessage{Plate: "RE05BKG"}, valid: true},
+		{given: &PlateMessage{Plate: ""}},
+		{given: &PlateMessage{Plate: "un1x"}},
+		{given: &PlateMessage{Plate: "UN 1X"}},
+		{given: &IAmDispatcherMessage{Roads: []uint16{66}}, valid: true},
+		{given: &IAmDispatcherMessage{}},
+	}
+
+	for _, test := range tests {
+		err := test.given.Validate()
+		if test.valid {
+			assert.NoError(t, err, "%+v", test.given)
+		} else {
+			assert.ErrorIs(t, err, ErrInvalidMessage, "%+v", test.given)
+		}
+	}
+}
@@ -28,7 +28,12 @@ type TicketDispatcher struct {
 // A single road has the same speed limit at every point on the road.
 // Positions on the roads are identified by the number of miles from the start of the road.
 // Remarkably, all speed cameras are positioned at exact integer numbers of miles from the start of the road.
-type Road struct{}
+type Road struct {
+	Number uint16
+	Limit  uint16
+	// Miles are the positions of the cameras on the road, in ascending order.
+	Miles []uint16
+}
 
 // A Car has a specific number plate represented as an uppercase alphanumeric string.
 type Car string
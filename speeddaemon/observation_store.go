@@ -0,0 +1,159 @@
+package speeddaemon
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// An ObservationStore records the camera observations of each car.
+type ObservationStore interface {
+	// Record stores an observation.
+	Record(r CameraRecord) error
+	// Observations returns every observation of a car, ordered by road and then by timestamp.
+	Observations(car Car) []CameraRecord
+	// Adjacent returns the observations of r's car on r's road immediately before and after r by timestamp.
+	Adjacent(r CameraRecord) []CameraRecord
+	// Between returns the observations of a car from timestamp from to timestamp to, along with the observations
+	// immediately before and after them on each road, ordered by road and then by timestamp.
+	Between(car Car, from, to uint32) []CameraRecord
+}
+
+// MemoryObservationStore keeps observations in memory, so they are lost when the server restarts.
+type MemoryObservationStore struct {
+	mu sync.Mutex
+
+	// recordings holds the observations of each car on each road, sorted by compareObservations.
+	recordings map[Car]map[uint16][]CameraRecord
+}
+
+func NewMemoryObservationStore() *MemoryObservationStore {
+	return &MemoryObservationStore{recordings: make(map[Car]map[uint16][]CameraRecord)}
+}
+
+// compareObservations orders observations of a car on a road by timestamp, and then by mile so that the order is
+// deterministic.
+func compareObservations(a, b CameraRecord) int {
+	return cmp.Or(cmp.Compare(a.Timestamp, b.Timestamp), cmp.Compare(a.Mile, b.Mile))
+}
+
+func (s *MemoryObservationStore) Record(r CameraRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roads, ok := s.recordings[Car(r.Plate)]
+	if !ok {
+		roads = make(map[uint16][]CameraRecord)
+		s.recordings[Car(r.Plate)] = roads
+	}
+	// Observations can arrive out of order, so each is inserted in place.
+	i, found := slices.BinarySearchFunc(roads[r.Road], r, compareObservations)
+	if !found {
+		roads[r.Road] = slices.Insert(roads[r.Road], i, r)
+	}
+	return nil
+}
+
+func (s *MemoryObservationStore) Observations(car Car) []CameraRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var observations []CameraRecord
+	for _, road := range slices.Sorted(maps.Keys(s.recordings[car])) {
+		observations = append(observations, s.recordings[car][road]...)
+	}
+	return observations
+}
+
+func (s *MemoryObservationStore) Adjacent(r CameraRecord) []CameraRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	observations := s.recordings[Car(r.Plate)][r.Road]
+	i, found := slices.BinarySearchFunc(observations, r, compareObservations)
+	var adjacent []CameraRecord
+	if i > 0 {
+		adjacent = append(adjacent, observations[i-1])
+	}
+	if found {
+		i++
+	}
+	if i < len(observations) {
+		adjacent = append(adjacent, observations[i])
+	}
+	return adjacent
+}
+
+func (s *MemoryObservationStore) Between(car Car, from, to uint32) []CameraRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var observations []CameraRecord
+	for _, road := range slices.Sorted(maps.Keys(s.recordings[car])) {
+		recorded := s.recordings[car][road]
+		first := sort.Search(len(recorded), func(i int) bool { return recorded[i].Timestamp >= from })
+		end := sort.Search(len(recorded), func(i int) bool { return recorded[i].Timestamp > to })
+		// The neighbours are included even if no observation falls in between, as the pair of them spans it.
+		observations = append(observations, recorded[max(first-1, 0):min(end+1, len(recorded))]...)
+	}
+	return observations
+}
+
+// FileObservationStore appends observations to a file of JSON lines, so they survive a restart of the server and can
+// be replayed with ReadObservations.
+//
+// Observations are also kept in memory for lookup.
+type FileObservationStore struct {
+	journal *journal
+	memory  *MemoryObservationStore
+}
+
+// OpenFileObservationStore opens the observation file at path, creating it if needed, and loads the observations
+// already recorded in it.
+func OpenFileObservationStore(path string) (*FileObservationStore, error) {
+	memory := NewMemoryObservationStore()
+	// Observations are frequent, and losing the last few in a power failure is acceptable, so they are not synced.
+	j, err := openJournal(path, false, memory.Record)
+	if err != nil {
+		return nil, fmt.Errorf("error loading observations: %w", err)
+	}
+	slog.Info("loaded observations", "path", path, "cars", len(memory.recordings))
+
+	return &FileObservationStore{journal: j, memory: memory}, nil
+}
+
+func (s *FileObservationStore) Record(r CameraRecord) error {
+	if err := s.journal.append(r); err != nil {
+		return fmt.Errorf("error writing observation: %w", err)
+	}
+	return s.memory.Record(r)
+}
+
+func (s *FileObservationStore) Observations(car Car) []CameraRecord {
+	return s.memory.Observations(car)
+}
+
+func (s *FileObservationStore) Adjacent(r CameraRecord) []CameraRecord {
+	return s.memory.Adjacent(r)
+}
+
+func (s *FileObservationStore) Between(car Car, from, to uint32) []CameraRecord {
+	return s.memory.Between(car, from, to)
+}
+
+func (s *FileObservationStore) Close() error {
+	return s.journal.Close()
+}
+
+// ReadObservations calls fn for each observation in r, in the order they were recorded.
+//
+// A truncated final observation, left behind by a crash while it was being written, is skipped.
+func ReadObservations(r io.Reader, fn func(CameraRecord) error) error {
+	_, err := readJournal(r, fn)
+	return err
+}
@@ -0,0 +1,93 @@
+package speeddaemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileObservationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "observations.jsonl")
+	first := CameraRecord{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 0}}
+	second := CameraRecord{Camera: Camera{Road: 123, Mile: 9, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 45}}
+	other := CameraRecord{Camera: Camera{Road: 66, Mile: 1, Limit: 40}, PlateMessage: PlateMessage{Plate: "RE05BKG", Timestamp: 7}}
+
+	store, err := OpenFileObservationStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Record(first))
+	require.NoError(t, store.Record(other))
+	require.NoError(t, store.Record(second))
+	assert.Equal(t, []CameraRecord{first, second}, store.Observations("UN1X"))
+	require.NoError(t, store.Close())
+
+	// Simulate a crash while an observation was being written.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Road":123,"Mile":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Observations survive a restart, and new ones are appended after the truncated one is dropped.
+	store, err = OpenFileObservationStore(path)
+	require.NoError(t, err)
+	assert.Equal(t, []CameraRecord{first, second}, store.Observations("UN1X"))
+	assert.Equal(t, []CameraRecord{other}, store.Observations("RE05BKG"))
+	third := CameraRecord{Camera: Camera{Road: 123, Mile: 10, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 90}}
+	require.NoError(t, store.Record(third))
+	require.NoError(t, store.Close())
+
+	f, err = os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var replayed []CameraRecord
+	require.NoError(t, ReadObservations(f, func(r CameraRecord) error {
+		replayed = append(replayed, r)
+		return nil
+	}))
+	assert.Equal(t, []CameraRecord{first, other, second, third}, replayed)
+}
+
+func TestMemoryObservationStore_Adjacent(t *testing.T) {
+	store := NewMemoryObservationStore()
+	observation := func(road, mile uint16, timestamp uint32) CameraRecord {
+		return CameraRecord{Camera: Camera{Road: road, Mile: mile, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: timestamp}}
+	}
+	first, second, third := observation(123, 8, 0), observation(123, 9, 45), observation(123, 10, 90)
+	elsewhere := observation(66, 1, 60)
+
+	// Observations arrive out of order.
+	for _, r := range []CameraRecord{third, elsewhere, first, second} {
+		require.NoError(t, store.Record(r))
+	}
+
+	assert.Equal(t, []CameraRecord{elsewhere, first, second, third}, store.Observations("UN1X"))
+	assert.Equal(t, []CameraRecord{second}, store.Adjacent(first))
+	assert.Equal(t, []CameraRecord{first, third}, store.Adjacent(second))
+	assert.Equal(t, []CameraRecord{second}, store.Adjacent(third))
+	assert.Empty(t, store.Adjacent(elsewhere))
+}
+
+func TestMemoryObservationStore_Between(t *testing.T) {
+	store := NewMemoryObservationStore()
+	observation := func(road, mile uint16, timestamp uint32) CameraRecord {
+		return CameraRecord{Camera: Camera{Road: road, Mile: mile, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: timestamp}}
+	}
+	var onRoad123 []CameraRecord
+	for i := range 5 {
+		onRoad123 = append(onRoad123, observation(123, uint16(i), uint32(i*100)))
+	}
+	before, after := observation(66, 1, 0), observation(66, 2, 500)
+	for _, r := range append([]CameraRecord{before, after}, onRoad123...) {
+		require.NoError(t, store.Record(r))
+	}
+
+	// The observations in between are returned with their neighbours on each road, so every pair of consecutive
+	// observations that spans part of the time is included.
+	assert.Equal(t, []CameraRecord{before, after, onRoad123[1], onRoad123[2], onRoad123[3], onRoad123[4]}, store.Between("UN1X", 200, 300))
+	assert.Equal(t, []CameraRecord{before, after, onRoad123[4]}, store.Between("UN1X", 450, 450))
+	assert.Equal(t, []CameraRecord{before, after, onRoad123[0], onRoad123[1]}, store.Between("UN1X", 0, 0))
+	assert.Empty(t, store.Between("N0N3", 0, 500))
+}
@@ -0,0 +1,164 @@
+package speeddaemon
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A RecordPipeline carries camera records to the enforcement workers without blocking cameras for long.
+//
+// Records are partitioned into shards by plate, and each shard is checked by its own worker, so the records of a car
+// are checked in the order they were received. Each shard holds a bounded number of records. When a shard is full, a
+// new record waits up to the pipeline's submit timeout for room, which absorbs bursts, and is then dropped from the
+// shard rather than stalling the camera that sent it any longer. A dropped record is deferred to the shard's worker,
+// which checks it once it catches up, so a car's last record is checked even if no record of the car follows it.
+type RecordPipeline struct {
+	mu     sync.RWMutex
+	closed bool
+
+	shards []chan CameraRecord
+	// deferredMu guards deferred, which holds the records dropped from each shard until its worker takes them.
+	deferredMu sync.Mutex
+	deferred   [][]CameraRecord
+	// deferredReady signals the worker of a shard that records have been deferred to it.
+	deferredReady []chan struct{}
+	// submitTimeout is how long a record waits for room in a full shard before it is dropped.
+	submitTimeout time.Duration
+	submitted     atomic.Uint64
+	dropped       atomic.Uint64
+}
+
+// RecordPipelineStats is a snapshot of the state of a RecordPipeline.
+type RecordPipelineStats struct {
+	// Depth is the number of records waiting in each shard.
+	Depth    []int `json:"depth"`
+	Capacity int   `json:"capacity"`
+	// Submitted counts the records accepted into the pipeline.
+	Submitted uint64 `json:"submitted"`
+	// Dropped counts the records rejected because their shard stayed full or the pipeline was closed. Records dropped
+	// from a full shard are deferred to its worker, but records submitted once the pipeline is closed are not checked.
+	Dropped uint64 `json:"dropped"`
+	// Deferred is the number of dropped records waiting for their worker to check them.
+	Deferred int `json:"deferred"`
+}
+
+// NewRecordPipeline returns a pipeline of shards, each holding up to capacity records.
+//
+// A record for a full shard waits up to submitTimeout for room before it is dropped, which is how long a slow
+// enforcement worker can stall a camera for each record. With a submitTimeout of 0, records are dropped without
+// waiting.
+func NewRecordPipeline(shards, capacity int, submitTimeout time.Duration) *RecordPipeline {
+	shards = max(shards, 1)
+	p := &RecordPipeline{
+		shards:        make([]chan CameraRecord, shards),
+		deferred:      make([][]CameraRecord, shards),
+		deferredReady: make([]chan struct{}, shards),
+		submitTimeout: submitTimeout,
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan CameraRecord, capacity)
+		p.deferredReady[i] = make(chan struct{}, 1)
+	}
+	return p
+}
+
+// Submit adds a record to the shard for its plate, waiting up to the submit timeout for room if the shard is full, and
+// reports whether it was accepted.
+func (p *RecordPipeline) Submit(r CameraRecord) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.dropped.Add(1)
+		return false
+	}
+	i := p.shard(r.Plate)
+	shard := p.shards[i]
+	select {
+	case shard <- r:
+		p.submitted.Add(1)
+		return true
+	default:
+	}
+	if p.submitTimeout <= 0 {
+		p.drop(i, r)
+		return false
+	}
+
+	timer := time.NewTimer(p.submitTimeout)
+	defer timer.Stop()
+	select {
+	case shard <- r:
+		p.submitted.Add(1)
+		return true
+	case <-timer.C:
+		p.drop(i, r)
+		return false
+	}
+}
+
+// drop defers a record that did not fit in shard i to the shard's worker.
+func (p *RecordPipeline) drop(i int, r CameraRecord) {
+	p.dropped.Add(1)
+	slog.Warn("record pipeline full, deferring record", "plate", r.Plate, "road", r.Road, "timestamp", r.Timestamp)
+
+	p.deferredMu.Lock()
+	p.deferred[i] = append(p.deferred[i], r)
+	p.deferredMu.Unlock()
+	select {
+	case p.deferredReady[i] <- struct{}{}:
+	default:
+	}
+}
+
+// takeDeferred returns the records deferred to the worker of shard i, and forgets them.
+func (p *RecordPipeline) takeDeferred(i int) []CameraRecord {
+	p.deferredMu.Lock()
+	defer p.deferredMu.Unlock()
+
+	deferred := p.deferred[i]
+	p.deferred[i] = nil
+	return deferred
+}
+
+// Close stops the pipeline accepting records. Records already submitted can still be received from the shards.
+func (p *RecordPipeline) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, shard := range p.shards {
+		close(shard)
+	}
+}
+
+// Stats returns a snapshot of the pipeline.
+func (p *RecordPipeline) Stats() RecordPipelineStats {
+	stats := RecordPipelineStats{
+		Depth:     make([]int, len(p.shards)),
+		Capacity:  cap(p.shards[0]),
+		Submitted: p.submitted.Load(),
+		Dropped:   p.dropped.Load(),
+	}
+	for i, shard := range p.shards {
+		stats.Depth[i] = len(shard)
+	}
+	p.deferredMu.Lock()
+	for _, deferred := range p.deferred {
+		stats.Deferred += len(deferred)
+	}
+	p.deferredMu.Unlock()
+	return stats
+}
+
+func (p *RecordPipeline) shard(plate string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(plate))
+	return int(h.Sum32() % uint32(len(p.shards)))
+}
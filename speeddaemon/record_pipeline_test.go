@@ -0,0 +1,60 @@
+package speeddaemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordPipeline_Submit(t *testing.T) {
+	p := NewRecordPipeline(2, 2, time.Millisecond)
+	record := func(plate string, timestamp uint32) CameraRecord {
+		return CameraRecord{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: plate, Timestamp: timestamp}}
+	}
+
+	// Records for a plate share a shard, so they stay in order and fill it up.
+	assert.True(t, p.Submit(record("UN1X", 0)))
+	assert.True(t, p.Submit(record("UN1X", 45)))
+	assert.False(t, p.Submit(record("UN1X", 90)))
+
+	shard := p.shards[p.shard("UN1X")]
+	assert.Equal(t, record("UN1X", 0), <-shard)
+	assert.Equal(t, record("UN1X", 45), <-shard)
+
+	p.Close()
+	assert.False(t, p.Submit(record("UN1X", 135)))
+	_, ok := <-shard
+	assert.False(t, ok)
+
+	stats := p.Stats()
+	assert.Equal(t, []int{0, 0}, stats.Depth)
+	assert.Equal(t, 2, stats.Capacity)
+	assert.Equal(t, uint64(2), stats.Submitted)
+	assert.Equal(t, uint64(2), stats.Dropped)
+}
+
+func TestRecordPipeline_SubmitWithoutTimeout(t *testing.T) {
+	p := NewRecordPipeline(1, 1, 0)
+	r := CameraRecord{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X"}}
+	assert.True(t, p.Submit(r))
+
+	// A full shard drops the record straight away.
+	start := time.Now()
+	assert.False(t, p.Submit(r))
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, uint64(1), p.Stats().Dropped)
+}
+
+func TestRecordPipeline_DefersDroppedRecords(t *testing.T) {
+	p := NewRecordPipeline(1, 1, 0)
+	r := CameraRecord{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X"}}
+	assert.True(t, p.Submit(r))
+	assert.False(t, p.Submit(r))
+
+	// The dropped record is handed to the shard's worker instead.
+	<-p.deferredReady[0]
+	assert.Equal(t, 1, p.Stats().Deferred)
+	assert.Equal(t, []CameraRecord{r}, p.takeDeferred(0))
+	assert.Zero(t, p.Stats().Deferred)
+}
@@ -0,0 +1,57 @@
+package speeddaemon
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var ErrConflictingLimit = errors.New("conflicting speed limit")
+
+// A RoadRegistry holds the roads known from connected cameras.
+//
+// The first camera on a road sets the road's speed limit, and every other camera on the road must agree with it.
+type RoadRegistry struct {
+	mu sync.Mutex
+
+	roads map[uint16]*Road
+}
+
+func NewRoadRegistry() *RoadRegistry {
+	return &RoadRegistry{roads: make(map[uint16]*Road)}
+}
+
+// Register adds a camera to its road, or returns an error wrapping ErrConflictingLimit if the camera reports a
+// different limit from the road's.
+func (r *RoadRegistry) Register(c Camera) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	road, ok := r.roads[c.Road]
+	if !ok {
+		road = &Road{Number: c.Road, Limit: c.Limit}
+		r.roads[c.Road] = road
+	}
+	if road.Limit != c.Limit {
+		return fmt.Errorf("%w: road %d has limit %d, camera at mile %d reported %d",
+			ErrConflictingLimit, c.Road, road.Limit, c.Mile, c.Limit)
+	}
+
+	if i, found := slices.BinarySearch(road.Miles, c.Mile); !found {
+		road.Miles = slices.Insert(road.Miles, i, c.Mile)
+	}
+	return nil
+}
+
+// Road returns a copy of a registered road.
+func (r *RoadRegistry) Road(number uint16) (Road, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	road, ok := r.roads[number]
+	if !ok {
+		return Road{}, false
+	}
+	return Road{Number: road.Number, Limit: road.Limit, Miles: slices.Clone(road.Miles)}, true
+}
@@ -0,0 +1,27 @@
+package speeddaemon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoadRegistry_Register(t *testing.T) {
+	r := NewRoadRegistry()
+	require.NoError(t, r.Register(Camera{Road: 123, Mile: 10, Limit: 60}))
+	require.NoError(t, r.Register(Camera{Road: 123, Mile: 8, Limit: 60}))
+	require.NoError(t, r.Register(Camera{Road: 123, Mile: 10, Limit: 60}))
+	require.NoError(t, r.Register(Camera{Road: 66, Mile: 1, Limit: 40}))
+
+	// A camera disagreeing with the road's limit is rejected without changing the road.
+	err := r.Register(Camera{Road: 123, Mile: 9, Limit: 70})
+	assert.ErrorIs(t, err, ErrConflictingLimit)
+
+	road, ok := r.Road(123)
+	require.True(t, ok)
+	assert.Equal(t, Road{Number: 123, Limit: 60, Miles: []uint16{8, 10}}, road)
+
+	_, ok = r.Road(368)
+	assert.False(t, ok)
+}
@@ -1,14 +1,19 @@
 package speeddaemon
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
 )
 
+// ErrServerClosed is returned by Serve and Handle once Shutdown has been called.
+var ErrServerClosed = errors.New("speed daemon server closed")
+
 // SpeedLimitEnforcementServer coordinates enforcement of average speed limits on the Freedom Island road network.
 //
 // Two types of clients are supported: cameras and ticket dispatchers.
@@ -18,37 +23,214 @@ import (
 // client an appropriate Error message and immediately disconnect that client.
 type SpeedLimitEnforcementServer struct {
 	ConnectionID atomic.Uint64
-	mu           sync.Mutex
 
 	CameraHandler     *CameraHandler
 	DispatcherHandler *DispatcherHandler
-	Records           <-chan CameraRecord
+	Records           *RecordPipeline
+	Tickets           TicketLedger
+	// Planner chooses which violations to ticket when they cannot all be ticketed.
+	Planner TicketPlanner
+
+	initOnce sync.Once
+	mu       sync.Mutex
+	closing  bool
+	listener net.Listener
+	clients  map[uint64]*Conn
+	// heartbeats sends the heartbeats of every client.
+	heartbeats *HeartbeatScheduler
+	// handlers tracks the running client handlers.
+	handlers sync.WaitGroup
+	// recording tracks the handlers that may still submit records: every client until it identifies as a dispatcher.
+	// Clients are added in track, before Shutdown waits for it.
+	recording sync.WaitGroup
+	// drained is closed when EnforceSpeedLimit returns.
+	drained chan struct{}
+}
 
-	// TODO: Please polish...
-	TicketsSent map[TicketOnDay]bool
+func (s *SpeedLimitEnforcementServer) init() {
+	s.initOnce.Do(func() {
+		s.clients = make(map[uint64]*Conn)
+		s.heartbeats = NewHeartbeatScheduler()
+		s.drained = make(chan struct{})
+	})
+}
+
+// Serve accepts connections on listener and handles each in a new goroutine, until Shutdown is called.
+func (s *SpeedLimitEnforcementServer) Serve(listener net.Listener) error {
+	s.init()
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	slog.Info("listening", "addr", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Warn("connection error", "err", err)
+			continue
+		}
+		go func() {
+			if err := s.Handle(conn); err != nil {
+				slog.Error("handler error", "err", err)
+			}
+		}()
+	}
+}
+
+// Shutdown stops the server without losing tickets.
+//
+// It stops accepting connections and disconnects cameras, then waits for EnforceSpeedLimit to check the records
+// already received, so their tickets are sent to the dispatchers still connected or left in the TicketQueue. Finally,
+// it disconnects the dispatchers. If ctx expires first, Shutdown returns its error, and Records is closed anyway so that
+// EnforceSpeedLimit returns once the records already submitted have been checked.
+//
+// EnforceSpeedLimit must be running for Shutdown to complete.
+func (s *SpeedLimitEnforcementServer) Shutdown(ctx context.Context) error {
+	s.init()
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	// Records is closed even if ctx expires first, so that EnforceSpeedLimit can return.
+	defer s.Records.Close()
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			slog.Warn("error closing listener", "err", err)
+		}
+	}
+	clients := make([]*Conn, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	slog.Info("shutting down speed daemon", "clients", len(clients))
+
+	// Closing a connection also stops its heartbeat.
+	var dispatchers []*Conn
+	for _, c := range clients {
+		if s.DispatcherHandler.isConnected(c) {
+			dispatchers = append(dispatchers, c)
+			continue
+		}
+		closeOrLog(c)
+	}
+	if err := waitContext(ctx, s.recording.Wait); err != nil {
+		return fmt.Errorf("error waiting for cameras: %w", err)
+	}
+
+	// The workers return once the records already submitted have been checked.
+	s.Records.Close()
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		return fmt.Errorf("error checking remaining records: %w", ctx.Err())
+	}
+
+	for _, c := range dispatchers {
+		closeOrLog(c)
+	}
+	if err := waitContext(ctx, s.handlers.Wait); err != nil {
+		return fmt.Errorf("error waiting for clients: %w", err)
+	}
+	slog.Info("speed daemon shut down")
+	return nil
+}
+
+func (s *SpeedLimitEnforcementServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closing
+}
+
+// track registers a client so Shutdown can close it, and reports false if the server is shutting down.
+func (s *SpeedLimitEnforcementServer) track(c *Conn) bool {
+	s.init()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.clients[c.ID] = c
+	s.handlers.Add(1)
+	s.recording.Add(1)
+	return true
+}
+
+func (s *SpeedLimitEnforcementServer) untrack(c *Conn) {
+	s.mu.Lock()
+	delete(s.clients, c.ID)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// waitContext calls wait, giving up when ctx is done.
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 var MultipleWantHeartbeatMessagesError = &ErrorMessage{Msg: "multiple WantHeartbeat messages"}
 
 // Handle handles a client connection.
 func (s *SpeedLimitEnforcementServer) Handle(conn net.Conn) error {
-	client := &Conn{Conn: conn, ID: s.ConnectionID.Add(1)}
+	s.init()
+	client := newConn(s.ConnectionID.Add(1), conn)
+	client.heartbeats = s.heartbeats
+	if !s.track(client) {
+		closeOrLog(client)
+		return ErrServerClosed
+	}
+	defer s.untrack(client)
 	slog.Info("client connected", "connection", client.ID)
 	defer closeOrLog(client)
+	recording := true
+	stopRecording := func() {
+		if recording {
+			recording = false
+			s.recording.Done()
+		}
+	}
+	defer stopRecording()
 
 	for {
-		var t uint8
-		if err := binary.Read(client, binary.BigEndian, &t); err != nil {
+		t, err := client.ReadByte()
+		if err != nil {
 			return fmt.Errorf("read error: %w", err)
 		}
 		switch t {
 		case IAmCameraMessageType:
 			return s.CameraHandler.handleCamera(client)
 		case IAmDispatcherMessageType:
+			// A dispatcher never submits records, so Shutdown need not wait for it before closing Records.
+			stopRecording()
 			return s.DispatcherHandler.handleDispatcher(client)
 		case WantHeartbeatMessageType:
 			// It is an error for a client to send multiple WantHeartbeat messages on a single connection.
-			if client.Heartbeat != nil {
+			if client.wantedHeartbeat {
 				return sendError(client, MultipleWantHeartbeatMessagesError)
 			}
 			if err := beginHeartbeat(client); err != nil {
@@ -61,39 +243,115 @@ func (s *SpeedLimitEnforcementServer) Handle(conn net.Conn) error {
 	}
 }
 
-// TODO: Accept context and terminate on shutdown.
-func (s *SpeedLimitEnforcementServer) EnforceSpeedLimit() error {
-	for r := range s.Records {
-		slog.Debug("checking tickets", "plate", r.Plate)
-		plate := r.PlateMessage.Plate
-		records := s.CameraHandler.FetchPlateRecords(plate)
+// EnforceSpeedLimit checks each record for speeding and tickets the offending cars, with a worker for each shard of
+// Records.
+//
+// It returns when ctx is done, or once Records is closed and the records already submitted have been checked.
+func (s *SpeedLimitEnforcementServer) EnforceSpeedLimit(ctx context.Context) error {
+	s.init()
+	defer close(s.drained)
 
-		var recordsOnRoad []CameraRecord
-		for _, other := range records {
-			if r == other {
-				continue
-			}
-			if other.Camera.Road == r.Camera.Road {
-				recordsOnRoad = append(recordsOnRoad, other)
+	var wg sync.WaitGroup
+	for i := range s.Records.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.enforce(ctx, i)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// enforce checks the records in shard i, and the records deferred to it, until ctx is done or the shard is closed and
+// empty.
+func (s *SpeedLimitEnforcementServer) enforce(ctx context.Context, i int) {
+	shard, deferred := s.Records.shards[i], s.Records.deferredReady[i]
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r, ok := <-shard:
+			if !ok {
+				// Records deferred before the pipeline was closed are checked before the worker returns.
+				s.checkDeferred(i)
+				return
 			}
+			s.check(r)
+		case <-deferred:
+			s.checkDeferred(i)
 		}
+	}
+}
 
-		for _, other := range recordsOnRoad {
-			distance := float64(max(r.Camera.Mile, other.Camera.Mile) - min(r.Camera.Mile, other.Camera.Mile))
-			duration := float64(max(r.Timestamp, other.Timestamp) - min(r.Timestamp, other.Timestamp))
-			mph := (distance / duration) * 3600
+// checkDeferred checks the records dropped from shard i because it was full.
+func (s *SpeedLimitEnforcementServer) checkDeferred(i int) {
+	for _, r := range s.Records.takeDeferred(i) {
+		s.check(r)
+	}
+}
 
-			// It is always required to ticket a car exceeding the speed limit by 0.5 mph or more.
-			// In cases where the car is exceeding the speed limit by less than 0.5 mph, it is acceptable to omit the ticket.
-			if float64(mph) > float64(r.Limit)+0.5 {
-				t := ticket(r, other, mph)
-				s.sendTicket(t)
-			}
+// check tickets the car in a new record if it has been speeding.
+//
+// Average speed is only inferred between consecutive observations on a road, so a new record is compared with the
+// observations immediately before and after it, even if it arrived out of order. If it reveals violations, the car's
+// violations on the days they cover are planned again together, against the tickets already issued, so that a new
+// violation is weighed against the ones found before it without checking the car's whole history.
+func (s *SpeedLimitEnforcementServer) check(r CameraRecord) {
+	slog.Debug("checking tickets", "plate", r.Plate)
+
+	first, last := uint32(math.MaxUint32), uint32(0)
+	for _, other := range s.CameraHandler.FetchAdjacentRecords(r) {
+		if v, ok := s.violation(r, other); ok {
+			first, last = min(first, day(v.Timestamp1)), max(last, day(v.Timestamp2))
+		}
+	}
+	if first > last {
+		return
+	}
+
+	// Every pair of consecutive observations that covers one of the days is a violation the new ones compete with.
+	from, to := first*86400, uint32(min(uint64(last+1)*86400-1, math.MaxUint32))
+	observations := s.CameraHandler.FetchPlateRecordsBetween(r.Plate, from, to)
+	var violations []TicketMessage
+	for i := 1; i < len(observations); i++ {
+		if v, ok := s.violation(observations[i], observations[i-1]); ok {
+			violations = append(violations, v)
 		}
+	}
 
-		slog.Debug("finished checking tickets", "plate", r.Plate)
+	ticketed := func(day uint32) bool { return s.Tickets.Ticketed(r.Plate, day) }
+	for _, t := range s.Planner.Plan(violations, ticketed) {
+		s.sendTicket(t)
 	}
-	return nil
+
+	slog.Debug("finished checking tickets", "plate", r.Plate)
+}
+
+// violation returns the ticket for a car's average speed between 2 of its observations, and reports whether it was
+// speeding.
+func (s *SpeedLimitEnforcementServer) violation(r, other CameraRecord) (TicketMessage, bool) {
+	if r.Road != other.Road || r.Timestamp == other.Timestamp {
+		// Speed is only inferred on a road, and a car cannot be observed at 2 points at once.
+		return TicketMessage{}, false
+	}
+
+	// Every camera on a road agrees on its limit, which is the road's authoritative limit.
+	limit := r.Limit
+	if road, ok := s.CameraHandler.FetchRoad(r.Road); ok {
+		limit = road.Limit
+	}
+
+	distance := float64(max(r.Camera.Mile, other.Camera.Mile) - min(r.Camera.Mile, other.Camera.Mile))
+	duration := float64(max(r.Timestamp, other.Timestamp) - min(r.Timestamp, other.Timestamp))
+	mph := (distance / duration) * 3600
+
+	// It is always required to ticket a car exceeding the speed limit by 0.5 mph or more.
+	// In cases where the car is exceeding the speed limit by less than 0.5 mph, it is acceptable to omit the ticket.
+	if mph > float64(limit)+0.5 {
+		return ticket(r, other, mph), true
+	}
+	return TicketMessage{}, false
 }
 
 func ticket(r CameraRecord, other CameraRecord, mph float64) TicketMessage {
@@ -114,54 +372,55 @@ func ticket(r CameraRecord, other CameraRecord, mph float64) TicketMessage {
 		Timestamp1: earlier.Timestamp,
 		Mile2:      later.Camera.Mile,
 		Timestamp2: later.Timestamp,
-		Speed:      uint16(mph * 100),
+		Speed:      ticketSpeed(r.Plate, mph),
 	}
 }
 
-func (s *SpeedLimitEnforcementServer) sendTicket(t TicketMessage) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	d1 := day(t.Timestamp1)
-	todStart := TicketOnDay{Plate: t.Plate, Day: d1}
-	d2 := day(t.Timestamp2)
-	todEnd := TicketOnDay{Plate: t.Plate, Day: d2}
-
-	_, ok1 := s.TicketsSent[todStart]
-	_, ok2 := s.TicketsSent[todEnd]
+// ticketSpeed returns mph multiplied by 100, as a ticket reports it.
+//
+// Speeds above 655.35 mph do not fit in a ticket, so they are clamped to the highest speed a ticket can report rather
+// than wrapping around to a low one.
+func ticketSpeed(plate string, mph float64) uint16 {
+	speed := mph * 100
+	if speed > math.MaxUint16 {
+		slog.Warn("speed too high for ticket, clamping", "plate", plate, "mph", mph)
+		return math.MaxUint16
+	}
+	return uint16(speed)
+}
 
-	// block if *any* day in the span is already ticketed
-	if ok1 || ok2 { // covers same-day and 2-day spans
+func (s *SpeedLimitEnforcementServer) sendTicket(t TicketMessage) {
+	// The server may only send 1 ticket per car per day, so a ticket is skipped if any day in its span is already ticketed.
+	issued, err := s.Tickets.Issue(t)
+	if err != nil {
+		slog.Error("error issuing ticket", "plate", t.Plate, "err", err)
+		return
+	}
+	if !issued {
 		slog.Debug("ticket overlaps used day; skipping",
-			"plate", t.Plate, "d1", d1, "d2", d2)
+			"plate", t.Plate, "d1", day(t.Timestamp1), "d2", day(t.Timestamp2))
 		return
 	}
-	s.TicketsSent[todStart] = true
-	s.TicketsSent[todEnd] = true
 	s.DispatcherHandler.SendTicket(t)
 }
 
-type TicketOnDay struct {
-	Plate string
-	Day   uint32
-}
-
 func day(timestamp uint32) uint32 {
 	// Since timestamps do not count leap seconds, days are defined by floor(timestamp / 86400).
-	// TODO: Maximize revenues.
 	return timestamp / 86400
 }
 
 var AlreadyIdentifiedError = &ErrorMessage{Msg: "client has already identified itself"}
 
 // sendError sends an ErrorMessage to the client.
-func sendError(client net.Conn, m *ErrorMessage) error {
+//
+// It is written like any other message, so it cannot interleave with a heartbeat or ticket, and is not failed by the
+// deadline an earlier write left on the connection.
+func sendError(client *Conn, m *ErrorMessage) error {
 	bytes, err := m.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("marshal error: %w", err)
 	}
-	_, err = client.Write(bytes)
-	if err != nil {
+	if err := client.writeMessage(bytes); err != nil {
 		return fmt.Errorf("write error: %w", err)
 	}
 	return nil
@@ -178,3 +437,12 @@ func closeOrLog(conn *Conn) {
 func illegalMessage(t uint8) *ErrorMessage {
 	return &ErrorMessage{Msg: fmt.Sprintf("illegal message: %02X", t)}
 }
+
+// rejectMessage sends the client an ErrorMessage explaining why a message is invalid, and returns an error so that
+// the client is disconnected.
+func rejectMessage(client *Conn, err error) error {
+	if sendErr := sendError(client, &ErrorMessage{Msg: err.Error()}); sendErr != nil {
+		return sendErr
+	}
+	return err
+}
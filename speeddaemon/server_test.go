@@ -0,0 +1,268 @@
+package speeddaemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpeedLimitEnforcementServer_EnforceSpeedLimitOutOfOrder(t *testing.T) {
+	observations := NewMemoryObservationStore()
+	records := NewRecordPipeline(4, 3, 0)
+	queue := NewMemoryTicketQueue()
+	s := &SpeedLimitEnforcementServer{
+		CameraHandler:     NewCameraHandler(observations, records),
+		DispatcherHandler: NewDispatcherHandler(queue, NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           NewMemoryTicketLedger(),
+	}
+
+	// The car drives slowly between miles 0 and 10, but the observation at mile 8 arrives last and shows it sped
+	// between miles 0 and 8.
+	for _, r := range []CameraRecord{
+		{Camera: Camera{Road: 123, Mile: 0, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 0}},
+		{Camera: Camera{Road: 123, Mile: 10, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 3600}},
+		{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 300}},
+	} {
+		require.NoError(t, observations.Record(r))
+		require.True(t, records.Submit(r))
+	}
+	records.Close()
+	require.NoError(t, s.EnforceSpeedLimit(context.Background()))
+
+	expected := TicketMessage{Plate: "UN1X", Road: 123, Mile1: 0, Timestamp1: 0, Mile2: 8, Timestamp2: 300, Speed: 9600}
+	assert.Equal(t, []TicketMessage{expected}, queue.Queued([]uint16{123}))
+}
+
+func TestSpeedLimitEnforcementServer_EnforceSpeedLimitPlansViolations(t *testing.T) {
+	observations := NewMemoryObservationStore()
+	records := NewRecordPipeline(4, 8, 0)
+	queue := NewMemoryTicketQueue()
+	s := &SpeedLimitEnforcementServer{
+		CameraHandler:     NewCameraHandler(observations, records),
+		DispatcherHandler: NewDispatcherHandler(queue, NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           NewMemoryTicketLedger(),
+	}
+
+	// UN1X speeds on road 3 over days 2 and 3, which arrives first, and on roads 1 and 2 over days 1 and 2 and days 3
+	// and 4. Ticketing the violations on roads 1 and 2 covers the most days.
+	var (
+		onRoad1 = TicketMessage{Plate: "UN1X", Road: 1, Mile1: 0, Timestamp1: 86400, Mile2: 2000, Timestamp2: 2 * 86400, Speed: 8333}
+		onRoad2 = TicketMessage{Plate: "UN1X", Road: 2, Mile1: 0, Timestamp1: 3 * 86400, Mile2: 2000, Timestamp2: 4 * 86400, Speed: 8333}
+		onRoad3 = TicketMessage{Plate: "UN1X", Road: 3, Mile1: 0, Timestamp1: 2*86400 + 100, Mile2: 2000, Timestamp2: 3*86400 + 100, Speed: 8333}
+	)
+	for _, v := range []TicketMessage{onRoad3, onRoad1, onRoad2} {
+		for _, r := range []CameraRecord{
+			{Camera: Camera{Road: v.Road, Mile: v.Mile1, Limit: 60}, PlateMessage: PlateMessage{Plate: v.Plate, Timestamp: v.Timestamp1}},
+			{Camera: Camera{Road: v.Road, Mile: v.Mile2, Limit: 60}, PlateMessage: PlateMessage{Plate: v.Plate, Timestamp: v.Timestamp2}},
+		} {
+			require.NoError(t, observations.Record(r))
+			require.True(t, records.Submit(r))
+		}
+	}
+	records.Close()
+	require.NoError(t, s.EnforceSpeedLimit(context.Background()))
+
+	assert.Equal(t, []TicketMessage{onRoad1, onRoad2}, queue.Queued([]uint16{1, 2, 3}))
+}
+
+func TestSpeedLimitEnforcementServer_EnforceSpeedLimitDroppedRecord(t *testing.T) {
+	observations := NewMemoryObservationStore()
+	records := NewRecordPipeline(1, 1, 0)
+	queue := NewMemoryTicketQueue()
+	s := &SpeedLimitEnforcementServer{
+		CameraHandler:     NewCameraHandler(observations, records),
+		DispatcherHandler: NewDispatcherHandler(queue, NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           NewMemoryTicketLedger(),
+	}
+	submit := func(r CameraRecord) bool {
+		require.NoError(t, observations.Record(r))
+		return records.Submit(r)
+	}
+
+	// UN1X is checked after its first observation, then its last observation is dropped because the shard is full of
+	// another car's record.
+	first := CameraRecord{Camera: Camera{Road: 123, Mile: 8, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 0}}
+	require.True(t, submit(first))
+	s.check(<-records.shards[0])
+	require.True(t, submit(CameraRecord{Camera: Camera{Road: 66, Mile: 1, Limit: 60}, PlateMessage: PlateMessage{Plate: "RE05BKG", Timestamp: 0}}))
+	require.False(t, submit(CameraRecord{Camera: Camera{Road: 123, Mile: 9, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: 45}}))
+
+	records.Close()
+	require.NoError(t, s.EnforceSpeedLimit(context.Background()))
+	expected := TicketMessage{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}
+	assert.Equal(t, []TicketMessage{expected}, queue.Queued([]uint16{123}))
+}
+
+// startServer starts a server on a local port, and returns it with its address and observations.
+func startServer(t *testing.T) (*SpeedLimitEnforcementServer, string, *MemoryObservationStore) {
+	t.Helper()
+
+	observations := NewMemoryObservationStore()
+	records := NewRecordPipeline(4, 16, time.Second)
+	s := &SpeedLimitEnforcementServer{
+		CameraHandler:     NewCameraHandler(observations, records),
+		DispatcherHandler: NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           NewMemoryTicketLedger(),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(listener) }()
+	go func() { _ = s.EnforceSpeedLimit(context.Background()) }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	return s, listener.Addr().String(), observations
+}
+
+func TestSpeedLimitEnforcementServer_Shutdown(t *testing.T) {
+	s, addr, observations := startServer(t)
+
+	dispatcher, err := DialDispatcher(addr, 123)
+	require.NoError(t, err)
+	defer dispatcher.Close()
+
+	// Cameras at miles 8 and 9 of road 123, with limit 60, see UN1X 45 seconds apart.
+	first, err := DialCamera(addr, 123, 8, 60)
+	require.NoError(t, err)
+	defer first.Close()
+	require.NoError(t, first.ReportPlate("UN1X", 0))
+	second, err := DialCamera(addr, 123, 9, 60)
+	require.NoError(t, err)
+	defer second.Close()
+	require.NoError(t, second.ReportPlate("UN1X", 45))
+	require.Eventually(t, func() bool {
+		return len(observations.Observations("UN1X")) == 2
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	// The ticket for the last record is sent to the dispatcher before it is disconnected.
+	assert.Equal(t, TicketMessage{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}, <-dispatcher.Tickets())
+	_, ok := <-dispatcher.Tickets()
+	assert.False(t, ok)
+	assert.NoError(t, dispatcher.Err())
+
+	_, err = DialCamera(addr, 123, 10, 60)
+	assert.Error(t, err)
+}
+
+func TestSpeedLimitEnforcementServer_ShutdownTimeoutStopsEnforcement(t *testing.T) {
+	records := NewRecordPipeline(4, 16, time.Second)
+	s := &SpeedLimitEnforcementServer{
+		CameraHandler:     NewCameraHandler(NewMemoryObservationStore(), records),
+		DispatcherHandler: NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy()),
+		Records:           records,
+		Tickets:           NewMemoryTicketLedger(),
+	}
+	enforced := make(chan error, 1)
+	go func() { enforced <- s.EnforceSpeedLimit(context.Background()) }()
+
+	// A camera that never finishes keeps Shutdown waiting until ctx expires.
+	s.init()
+	s.recording.Add(1)
+	defer s.recording.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case err := <-enforced:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("EnforceSpeedLimit did not return after Shutdown gave up")
+	}
+}
+
+func Test_ticketSpeed(t *testing.T) {
+	assert.Equal(t, uint16(6000), ticketSpeed("UN1X", 60))
+	assert.Equal(t, uint16(65535), ticketSpeed("UN1X", 655.35))
+	// 700 mph would wrap around to 4464 if it were not clamped.
+	assert.Equal(t, uint16(math.MaxUint16), ticketSpeed("UN1X", 700))
+}
+
+func TestSpeedLimitEnforcementServer_HandleWantHeartbeat(t *testing.T) {
+	// Handle is called directly, without Serve, EnforceSpeedLimit or Shutdown having initialized the server.
+	s := &SpeedLimitEnforcementServer{}
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() { _ = s.Handle(server) }()
+
+	data, err := (&WantHeartbeatMessage{Interval: 1}).MarshalBinary()
+	require.NoError(t, err)
+	_, err = client.Write(data)
+	require.NoError(t, err)
+
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{HeartbeatMessageType}, buf)
+}
+
+func TestSpeedLimitEnforcementServer_ErrorAfterHeartbeat(t *testing.T) {
+	_, addr, _ := startServer(t)
+	client, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer client.Close()
+
+	encoder, decoder := NewEncoder(client), NewDecoder(client)
+	require.NoError(t, client.SetDeadline(time.Now().Add(time.Second)))
+	require.NoError(t, encoder.Encode(&WantHeartbeatMessage{Interval: 3}))
+	m, err := decoder.Decode()
+	require.NoError(t, err)
+	assert.IsType(t, &HeartbeatMessage{}, m)
+
+	// The heartbeat's write deadline has passed by the time the client misbehaves, before the next heartbeat is due, and
+	// the Error is still delivered.
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.Write([]byte{0xFF})
+	require.NoError(t, err)
+	for {
+		m, err := decoder.Decode()
+		require.NoError(t, err)
+		if _, ok := m.(*HeartbeatMessage); ok {
+			continue
+		}
+		assert.Equal(t, illegalMessage(0xFF), m)
+		return
+	}
+}
+
+func BenchmarkSpeedLimitEnforcementServer_check(b *testing.B) {
+	for _, sightings := range []int{2000, 8000} {
+		b.Run(fmt.Sprintf("sightings=%d", sightings), func(b *testing.B) {
+			observations := NewMemoryObservationStore()
+			s := &SpeedLimitEnforcementServer{
+				CameraHandler:     NewCameraHandler(observations, NewRecordPipeline(1, 1, 0)),
+				DispatcherHandler: NewDispatcherHandler(NewMemoryTicketQueue(), NewRoundRobinPolicy()),
+				Tickets:           NewMemoryTicketLedger(),
+			}
+			// UN1X speeds between every pair of its sightings, twice a day.
+			var last CameraRecord
+			for i := range sightings {
+				last = CameraRecord{Camera: Camera{Road: 1, Mile: uint16(i%2) * 5000, Limit: 60}, PlateMessage: PlateMessage{Plate: "UN1X", Timestamp: uint32(i) * 43200}}
+				require.NoError(b, observations.Record(last))
+				s.check(last)
+			}
+
+			for b.Loop() {
+				s.check(last)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package speeddaemon
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// A TicketLedger records the tickets issued to each car, and the days they cover.
+//
+// The server may only send every car 1 ticket per day, so a ticket is only issued if none of its days are taken.
+type TicketLedger interface {
+	// Issue records t, unless the car has already been ticketed on one of the days t covers, and reports whether t
+	// was recorded.
+	Issue(t TicketMessage) (bool, error)
+	// Ticketed reports whether the car has been ticketed on day.
+	Ticketed(plate string, day uint32) bool
+}
+
+// An IssuedTicket is a ticket recorded in a TicketLedger, along with the days it covers.
+type IssuedTicket struct {
+	Ticket TicketMessage
+	Days   []uint32
+}
+
+type TicketOnDay struct {
+	Plate string
+	Day   uint32
+}
+
+// ticketDays returns every day a ticket covers, from the day of its first observation to the day of its second.
+func ticketDays(t TicketMessage) []uint32 {
+	var days []uint32
+	for d := day(t.Timestamp1); d <= day(t.Timestamp2); d++ {
+		days = append(days, d)
+	}
+	return days
+}
+
+// MemoryTicketLedger keeps issued tickets in memory, so they are forgotten when the server restarts.
+type MemoryTicketLedger struct {
+	mu sync.Mutex
+
+	ticketed map[TicketOnDay]bool
+}
+
+func NewMemoryTicketLedger() *MemoryTicketLedger {
+	return &MemoryTicketLedger{ticketed: make(map[TicketOnDay]bool)}
+}
+
+func (l *MemoryTicketLedger) Issue(t TicketMessage) (bool, error) {
+	return l.issue(t, nil)
+}
+
+// issue records t unless one of its days is taken, calling persist first so a ticket is only recorded once it is
+// safely stored.
+func (l *MemoryTicketLedger) issue(t TicketMessage, persist func(IssuedTicket) error) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	days := ticketDays(t)
+	for _, d := range days {
+		if l.ticketed[TicketOnDay{Plate: t.Plate, Day: d}] {
+			return false, nil
+		}
+	}
+
+	issued := IssuedTicket{Ticket: t, Days: days}
+	if persist != nil {
+		if err := persist(issued); err != nil {
+			return false, err
+		}
+	}
+	l.record(issued)
+	return true, nil
+}
+
+func (l *MemoryTicketLedger) Ticketed(plate string, day uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ticketed[TicketOnDay{Plate: plate, Day: day}]
+}
+
+func (l *MemoryTicketLedger) record(t IssuedTicket) {
+	for _, d := range t.Days {
+		l.ticketed[TicketOnDay{Plate: t.Ticket.Plate, Day: d}] = true
+	}
+}
+
+// FileTicketLedger writes every issued ticket to a write-ahead log before it is sent, so a restarted server does not
+// ticket a car twice on the same day.
+type FileTicketLedger struct {
+	journal *journal
+	memory  *MemoryTicketLedger
+	// recovered holds the tickets read from the log when it was opened.
+	recovered []TicketMessage
+}
+
+// OpenFileTicketLedger opens the ticket log at path, creating it if needed, and recovers the tickets already issued.
+func OpenFileTicketLedger(path string) (*FileTicketLedger, error) {
+	memory := NewMemoryTicketLedger()
+	var recovered []TicketMessage
+	j, err := openJournal(path, true, func(t IssuedTicket) error {
+		memory.record(t)
+		recovered = append(recovered, t.Ticket)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error recovering tickets: %w", err)
+	}
+	slog.Info("recovered tickets", "path", path, "count", len(recovered))
+
+	return &FileTicketLedger{journal: j, memory: memory, recovered: recovered}, nil
+}
+
+func (l *FileTicketLedger) Issue(t TicketMessage) (bool, error) {
+	return l.memory.issue(t, func(issued IssuedTicket) error {
+		if err := l.journal.append(issued); err != nil {
+			return fmt.Errorf("error writing ticket: %w", err)
+		}
+		return nil
+	})
+}
+
+func (l *FileTicketLedger) Ticketed(plate string, day uint32) bool {
+	return l.memory.Ticketed(plate, day)
+}
+
+// Recovered returns the tickets that had been issued when the ledger was opened.
+func (l *FileTicketLedger) Recovered() []TicketMessage {
+	return l.recovered
+}
+
+func (l *FileTicketLedger) Close() error {
+	return l.journal.Close()
+}
@@ -0,0 +1,50 @@
+package speeddaemon
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTicketLedger_Issue(t *testing.T) {
+	l := NewMemoryTicketLedger()
+
+	// A ticket spanning several days takes every day in between.
+	issued, err := l.Issue(TicketMessage{Plate: "UN1X", Timestamp1: 86400, Timestamp2: 3*86400 + 1})
+	require.NoError(t, err)
+	assert.True(t, issued)
+	assert.True(t, l.Ticketed("UN1X", 2))
+	assert.False(t, l.Ticketed("UN1X", 4))
+
+	issued, err = l.Issue(TicketMessage{Plate: "UN1X", Timestamp1: 2 * 86400, Timestamp2: 2*86400 + 60})
+	require.NoError(t, err)
+	assert.False(t, issued)
+
+	// Other cars are ticketed independently.
+	issued, err = l.Issue(TicketMessage{Plate: "RE05BKG", Timestamp1: 2 * 86400, Timestamp2: 2*86400 + 60})
+	require.NoError(t, err)
+	assert.True(t, issued)
+}
+
+func TestFileTicketLedger_Recovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets.jsonl")
+	ticket := TicketMessage{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000}
+
+	l, err := OpenFileTicketLedger(path)
+	require.NoError(t, err)
+	issued, err := l.Issue(ticket)
+	require.NoError(t, err)
+	assert.True(t, issued)
+	require.NoError(t, l.Close())
+
+	// A restarted server remembers which days were ticketed.
+	l, err = OpenFileTicketLedger(path)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.True(t, l.Ticketed("UN1X", day(123456)))
+	issued, err = l.Issue(ticket)
+	require.NoError(t, err)
+	assert.False(t, issued)
+}
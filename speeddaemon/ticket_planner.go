@@ -0,0 +1,103 @@
+package speeddaemon
+
+import (
+	"cmp"
+	"slices"
+)
+
+// A PlanObjective is the value a TicketPlanner maximizes.
+type PlanObjective int
+
+const (
+	// MostDays maximizes the number of days covered by tickets.
+	MostDays PlanObjective = iota
+	// HighestSpeed maximizes the total speed of the tickets.
+	HighestSpeed
+)
+
+// A TicketPlanner chooses which of a car's violations to ticket.
+//
+// The server may only send every car 1 ticket per day, but a ticket covers every day from its first observation to its
+// second, so ticketing one violation can rule out several others. Instead of ticketing violations in the order they
+// are found, the planner chooses the set of tickets with the most value that do not share a day.
+//
+// The zero value maximizes the days covered.
+type TicketPlanner struct {
+	Objective PlanObjective
+}
+
+// Plan returns the tickets to issue from a car's violations, given the days it has already been ticketed on.
+//
+// Tickets that have been sent cannot be withdrawn, so violations on an already ticketed day are never chosen. The
+// plan only depends on the violations and ticketed days given, and not on the order of the violations. The server
+// plans again as observations arrive, though, so which tickets a car ends up with can depend on the order its
+// observations arrive in: a violation ticketed before a late observation arrives rules out the violations that
+// observation reveals on the same days.
+func (p TicketPlanner) Plan(violations []TicketMessage, ticketed func(day uint32) bool) []TicketMessage {
+	var candidates []TicketMessage
+	for _, t := range violations {
+		if !slices.ContainsFunc(ticketDays(t), ticketed) {
+			candidates = append(candidates, t)
+		}
+	}
+	slices.SortFunc(candidates, compareTickets)
+	candidates = slices.Compact(candidates)
+
+	// This is weighted interval scheduling: best[i] is the most value from the first i candidates, which are ordered by
+	// their last day.
+	best := make([]uint64, len(candidates)+1)
+	for i, t := range candidates {
+		taken := p.value(t) + best[compatible(candidates, i)]
+		best[i+1] = max(best[i], taken)
+	}
+
+	var plan []TicketMessage
+	for i := len(candidates); i > 0; {
+		t := candidates[i-1]
+		if best[i] == best[i-1] {
+			// Leaving the candidate out is as good as taking it.
+			i--
+			continue
+		}
+		plan = append(plan, t)
+		i = compatible(candidates, i-1)
+	}
+	slices.Reverse(plan)
+	return plan
+}
+
+func (p TicketPlanner) value(t TicketMessage) uint64 {
+	switch p.Objective {
+	case HighestSpeed:
+		return uint64(t.Speed)
+	default:
+		return uint64(day(t.Timestamp2) - day(t.Timestamp1) + 1)
+	}
+}
+
+// compatible returns the number of candidates before candidates[i] that end before it begins.
+func compatible(candidates []TicketMessage, i int) int {
+	first := day(candidates[i].Timestamp1)
+	n, _ := slices.BinarySearchFunc(candidates[:i], first, func(t TicketMessage, d uint32) int {
+		// Candidates ending on the first day overlap, so they sort after it.
+		if day(t.Timestamp2) < d {
+			return -1
+		}
+		return 1
+	})
+	return n
+}
+
+// compareTickets orders tickets by their last day, and then by every other field so that plans are deterministic.
+func compareTickets(a, b TicketMessage) int {
+	return cmp.Or(
+		cmp.Compare(day(a.Timestamp2), day(b.Timestamp2)),
+		cmp.Compare(a.Timestamp1, b.Timestamp1),
+		cmp.Compare(a.Timestamp2, b.Timestamp2),
+		cmp.Compare(a.Road, b.Road),
+		cmp.Compare(a.Mile1, b.Mile1),
+		cmp.Compare(a.Mile2, b.Mile2),
+		cmp.Compare(a.Speed, b.Speed),
+		cmp.Compare(a.Plate, b.Plate),
+	)
+}
@@ -0,0 +1,62 @@
+package speeddaemon
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// violation returns a ticket for UN1X from the start of day d1 to the start of day d2.
+func violation(d1, d2 uint32, speed uint16) TicketMessage {
+	return TicketMessage{Plate: "UN1X", Road: 123, Timestamp1: d1 * 86400, Timestamp2: d2*86400 + 60, Speed: speed}
+}
+
+func TestTicketPlanner_Plan(t *testing.T) {
+	long := violation(1, 3, 7000)
+	first, second, third := violation(1, 1, 9000), violation(2, 2, 9000), violation(3, 4, 6500)
+	violations := []TicketMessage{long, first, second, third}
+	notTicketed := func(uint32) bool { return false }
+
+	tests := []struct {
+		name      string
+		objective PlanObjective
+		ticketed  func(uint32) bool
+		expected  []TicketMessage
+	}{
+		{name: "most days", objective: MostDays, ticketed: notTicketed, expected: []TicketMessage{first, second, third}},
+		{name: "highest speed", objective: HighestSpeed, ticketed: notTicketed, expected: []TicketMessage{first, second, third}},
+		{
+			name:      "already ticketed",
+			objective: MostDays,
+			ticketed:  func(d uint32) bool { return d == 2 },
+			expected:  []TicketMessage{first, third},
+		},
+		{
+			name:      "nothing left",
+			objective: MostDays,
+			ticketed:  func(d uint32) bool { return d >= 1 },
+			expected:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := TicketPlanner{Objective: tt.objective}
+			assert.Equal(t, tt.expected, p.Plan(violations, tt.ticketed))
+		})
+	}
+}
+
+func TestTicketPlanner_PlanIsDeterministic(t *testing.T) {
+	violations := []TicketMessage{violation(1, 2, 7000), violation(2, 3, 7000), violation(3, 3, 8000), violation(1, 1, 8000)}
+	p := TicketPlanner{}
+	expected := p.Plan(violations, func(uint32) bool { return false })
+
+	// The plan does not depend on the order violations are found in.
+	for range 10 {
+		shuffled := append([]TicketMessage(nil), violations...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		assert.Equal(t, expected, p.Plan(shuffled, func(uint32) bool { return false }))
+	}
+}
@@ -0,0 +1,143 @@
+package speeddaemon
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// A TicketQueue holds tickets until they have been written to a dispatcher.
+type TicketQueue interface {
+	// Enqueue adds a ticket to the queue.
+	Enqueue(t TicketMessage) error
+	// Queued returns the queued tickets for any of roads, in the order they were queued.
+	Queued(roads []uint16) []TicketMessage
+	// Delivered removes a ticket from the queue once it has been written to a dispatcher.
+	Delivered(t TicketMessage) error
+}
+
+// MemoryTicketQueue keeps queued tickets in memory, so they are lost when the server restarts.
+type MemoryTicketQueue struct {
+	mu sync.Mutex
+
+	tickets []TicketMessage
+}
+
+func NewMemoryTicketQueue() *MemoryTicketQueue {
+	return &MemoryTicketQueue{}
+}
+
+func (q *MemoryTicketQueue) Enqueue(t TicketMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.tickets = append(q.tickets, t)
+	return nil
+}
+
+func (q *MemoryTicketQueue) Queued(roads []uint16) []TicketMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var queued []TicketMessage
+	for _, t := range q.tickets {
+		if slices.Contains(roads, t.Road) {
+			queued = append(queued, t)
+		}
+	}
+	return queued
+}
+
+func (q *MemoryTicketQueue) Delivered(t TicketMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i := slices.Index(q.tickets, t); i >= 0 {
+		q.tickets = slices.Delete(q.tickets, i, i+1)
+	}
+	return nil
+}
+
+func (q *MemoryTicketQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.tickets)
+}
+
+// ticketQueueEntry is a change to a FileTicketQueue.
+type ticketQueueEntry struct {
+	Ticket    TicketMessage
+	Delivered bool
+}
+
+// FileTicketQueue logs every queued and delivered ticket, so tickets still waiting for a dispatcher survive a restart.
+type FileTicketQueue struct {
+	journal *journal
+	memory  *MemoryTicketQueue
+	// logged holds every ticket in the log when it was opened, queued or delivered, until Requeue is called.
+	logged map[TicketMessage]bool
+}
+
+// OpenFileTicketQueue opens the queue log at path, creating it if needed, and recovers the tickets still queued.
+func OpenFileTicketQueue(path string) (*FileTicketQueue, error) {
+	memory := NewMemoryTicketQueue()
+	logged := make(map[TicketMessage]bool)
+	j, err := openJournal(path, true, func(e ticketQueueEntry) error {
+		logged[e.Ticket] = true
+		if e.Delivered {
+			return memory.Delivered(e.Ticket)
+		}
+		return memory.Enqueue(e.Ticket)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error recovering ticket queue: %w", err)
+	}
+	slog.Info("recovered ticket queue", "path", path, "queued", memory.Len())
+
+	return &FileTicketQueue{journal: j, memory: memory, logged: logged}, nil
+}
+
+func (q *FileTicketQueue) Enqueue(t TicketMessage) error {
+	if err := q.journal.append(ticketQueueEntry{Ticket: t}); err != nil {
+		return fmt.Errorf("error writing queued ticket: %w", err)
+	}
+	return q.memory.Enqueue(t)
+}
+
+// Requeue queues the issued tickets that were never queued, and returns how many it queued.
+//
+// A ticket is recorded in the TicketLedger before it is queued, so a crash between the two leaves its days ticketed
+// with no ticket to deliver. Requeue is called with the tickets recovered by the ledger when the server starts, before
+// any tickets are sent.
+func (q *FileTicketQueue) Requeue(issued []TicketMessage) (int, error) {
+	var requeued int
+	for _, t := range issued {
+		if q.logged[t] {
+			continue
+		}
+		slog.Warn("requeueing ticket that was issued but never queued", "plate", t.Plate, "road", t.Road)
+		if err := q.Enqueue(t); err != nil {
+			return requeued, err
+		}
+		requeued++
+	}
+	q.logged = nil
+	return requeued, nil
+}
+
+func (q *FileTicketQueue) Queued(roads []uint16) []TicketMessage {
+	return q.memory.Queued(roads)
+}
+
+func (q *FileTicketQueue) Delivered(t TicketMessage) error {
+	if err := q.journal.append(ticketQueueEntry{Ticket: t, Delivered: true}); err != nil {
+		return fmt.Errorf("error writing delivered ticket: %w", err)
+	}
+	return q.memory.Delivered(t)
+}
+
+func (q *FileTicketQueue) Close() error {
+	return q.journal.Close()
+}